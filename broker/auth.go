@@ -0,0 +1,171 @@
+package broker
+
+import (
+	"errors"
+
+	"busy-cloud/gnet-mqtt/mqtt"
+)
+
+// ErrAuthFailed 认证失败
+var ErrAuthFailed = errors.New("authentication failed")
+
+// Authenticator 增强认证方法（MQTT 5.0），一个实例处理一种认证方法
+type Authenticator interface {
+	// Method 认证方法名，对应Authentication Method属性
+	Method() string
+	// Start 为一次CONNECT或重新认证开始新的认证交换
+	Start(clientID []byte) AuthExchange
+}
+
+// AuthExchange 单个连接的一次认证交换，可经过多轮挑战/响应
+type AuthExchange interface {
+	// Next 处理客户端发送的认证数据，返回发送给客户端的认证数据
+	// done为true表示认证成功，err不为nil表示认证失败
+	Next(data []byte) (response []byte, done bool, err error)
+	// Principal 认证成功后确认的身份（如用户名），作为客户端的用户名
+	Principal() string
+}
+
+// authState 进行中的增强认证
+type authState struct {
+	method   string
+	exchange AuthExchange
+	connect  *mqtt.ConnectPacket // 认证完成后继续处理的CONNECT，重新认证时为nil
+}
+
+// RegisterAuthenticator 注册增强认证方法，同名方法会被替换
+func (m *Manager) RegisterAuthenticator(authenticator Authenticator) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.authenticators == nil {
+		m.authenticators = make(map[string]Authenticator)
+	}
+	m.authenticators[authenticator.Method()] = authenticator
+}
+
+// authenticator 查找认证方法
+func (m *Manager) authenticator(method string) (Authenticator, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	authenticator, ok := m.authenticators[method]
+	return authenticator, ok
+}
+
+// startConnectAuth 开始CONNECT中请求的增强认证，认证完成后继续建立连接
+func (m *Manager) startConnectAuth(clientCtx *ClientContext, p *mqtt.ConnectPacket) {
+	method := string(p.Properties.AuthenticationMethod)
+	authenticator, ok := m.authenticator(method)
+	if !ok {
+		m.refuseConnect(clientCtx, mqtt.Version5, mqtt.ReasonBadAuthenticationMethod, nil)
+		return
+	}
+
+	clientCtx.auth = &authState{
+		method:   method,
+		exchange: authenticator.Start(p.ClientID),
+		connect:  p,
+	}
+	m.continueAuth(clientCtx, p.Properties.AuthenticationData)
+}
+
+// continueAuth 将客户端的认证数据交给认证方法，根据结果继续挑战、完成或拒绝
+func (m *Manager) continueAuth(clientCtx *ClientContext, data []byte) {
+	auth := clientCtx.auth
+	response, done, err := auth.exchange.Next(data)
+	if err != nil {
+		clientCtx.auth = nil
+		m.logger.Warn("Authentication failed",
+			"client_id", string(clientCtx.Client.ClientID),
+			"remote_addr", clientCtx.Conn.RemoteAddr().String(),
+			"method", auth.method,
+			"error", err)
+		if auth.connect != nil {
+			m.refuseConnect(clientCtx, mqtt.Version5, mqtt.ReasonNotAuthorized, nil)
+		} else {
+			m.disconnect(clientCtx, mqtt.ReasonNotAuthorized)
+		}
+		return
+	}
+
+	props := &mqtt.Properties{
+		AuthenticationMethod: []byte(auth.method),
+		AuthenticationData:   response,
+	}
+	if !done {
+		clientCtx.send(mqtt.CreateAuth(mqtt.ReasonContinueAuthentication, props))
+		return
+	}
+
+	clientCtx.auth = nil
+	clientCtx.authMethod = auth.method
+	principal := auth.exchange.Principal()
+	if auth.connect != nil {
+		// CONNECT中的用户名必须与认证的身份一致，未提供时使用认证的身份
+		if auth.connect.UsernameFlag && string(auth.connect.Username) != principal {
+			m.logger.Warn("Username does not match authenticated identity",
+				"client_id", string(clientCtx.Client.ClientID),
+				"username", string(auth.connect.Username),
+				"principal", principal)
+			m.refuseConnect(clientCtx, mqtt.Version5, mqtt.ReasonNotAuthorized, nil)
+			return
+		}
+		auth.connect.Username = []byte(principal)
+		auth.connect.UsernameFlag = true
+		m.completeConnect(clientCtx, auth.connect, props)
+		return
+	}
+
+	// 重新认证不能切换身份
+	if principal != string(clientCtx.Client.Username) {
+		m.logger.Warn("Re-authentication changed identity, closing connection",
+			"client_id", string(clientCtx.Client.ClientID),
+			"username", string(clientCtx.Client.Username),
+			"principal", principal)
+		m.disconnect(clientCtx, mqtt.ReasonNotAuthorized)
+		return
+	}
+
+	m.logger.Info("Client re-authenticated",
+		"client_id", string(clientCtx.Client.ClientID),
+		"method", auth.method)
+	clientCtx.send(mqtt.CreateAuth(mqtt.ReasonSuccess, props))
+}
+
+// handleAuth 处理AUTH报文，用于CONNECT期间的多轮认证和连接后的重新认证
+func (m *Manager) handleAuth(clientCtx *ClientContext, p *mqtt.AuthPacket) {
+	var method string
+	var data []byte
+	if p.Properties != nil {
+		method = string(p.Properties.AuthenticationMethod)
+		data = p.Properties.AuthenticationData
+	}
+
+	switch {
+	case p.ReasonCode == mqtt.ReasonContinueAuthentication && clientCtx.auth != nil && method == clientCtx.auth.method:
+		m.continueAuth(clientCtx, data)
+		return
+	case p.ReasonCode == mqtt.ReasonReAuthenticate && clientCtx.Client.Connected &&
+		clientCtx.auth == nil && clientCtx.authMethod != "" && method == clientCtx.authMethod:
+		// 重新认证必须使用建立连接时的认证方法
+		if authenticator, ok := m.authenticator(method); ok {
+			clientCtx.auth = &authState{
+				method:   method,
+				exchange: authenticator.Start(clientCtx.Client.ClientID),
+			}
+			m.continueAuth(clientCtx, data)
+			return
+		}
+	}
+
+	m.logger.Warn("Unexpected AUTH packet, closing connection",
+		"client_id", string(clientCtx.Client.ClientID),
+		"reason_code", p.ReasonCode,
+		"method", method)
+	if clientCtx.Client.Connected {
+		m.disconnect(clientCtx, mqtt.ReasonProtocolError)
+	} else {
+		clientCtx.Conn.Close()
+	}
+}
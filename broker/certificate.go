@@ -0,0 +1,74 @@
+package broker
+
+import (
+	"bytes"
+	"crypto/x509"
+
+	"busy-cloud/gnet-mqtt/mqtt"
+	"busy-cloud/gnet-mqtt/types"
+)
+
+// CertIdentity 客户端证书中用作身份的字段
+type CertIdentity string
+
+const (
+	CertIdentityNone CertIdentity = ""    // 不使用证书
+	CertIdentityCN   CertIdentity = "cn"  // Subject Common Name
+	CertIdentitySAN  CertIdentity = "san" // 第一个DNS名称、邮箱地址或URI
+)
+
+// value 从客户端证书中取出身份
+func (f CertIdentity) value(cert *x509.Certificate) []byte {
+	switch f {
+	case CertIdentityCN:
+		return []byte(cert.Subject.CommonName)
+	case CertIdentitySAN:
+		switch {
+		case len(cert.DNSNames) > 0:
+			return []byte(cert.DNSNames[0])
+		case len(cert.EmailAddresses) > 0:
+			return []byte(cert.EmailAddresses[0])
+		case len(cert.URIs) > 0:
+			return []byte(cert.URIs[0].String())
+		}
+	}
+	return nil
+}
+
+// applyCertIdentity 按配置用客户端证书中的身份替换CONNECT中的ClientID和用户名
+// 证书缺少配置的字段，或没有证书的连接使用了已由证书绑定的ClientID时返回false
+func (m *Manager) applyCertIdentity(clientCtx *ClientContext, p *mqtt.ConnectPacket) bool {
+	if m.config.CertClientID == CertIdentityNone && m.config.CertUsername == CertIdentityNone {
+		return true
+	}
+	var certs []*x509.Certificate
+	if conn, ok := clientCtx.Conn.(types.CertificateConn); ok {
+		certs = conn.PeerCertificates()
+	}
+	if len(certs) == 0 {
+		// 防止没有证书的连接冒用设备的ClientID接管其会话
+		_, bound := m.certClientIDs.Load(string(p.ClientID))
+		return !bound
+	}
+
+	if m.config.CertClientID != CertIdentityNone {
+		clientID := m.config.CertClientID.value(certs[0])
+		if len(clientID) == 0 {
+			return false
+		}
+		// 与客户端提供的ClientID不同时通过CONNACK告知MQTT 5.0客户端
+		clientCtx.clientIDAssigned = !bytes.Equal(clientID, p.ClientID)
+		p.ClientID = clientID
+		m.certClientIDs.Store(string(clientID), struct{}{})
+	}
+
+	if m.config.CertUsername != CertIdentityNone {
+		username := m.config.CertUsername.value(certs[0])
+		if len(username) == 0 {
+			return false
+		}
+		p.Username = username
+		p.UsernameFlag = true
+	}
+	return true
+}
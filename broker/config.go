@@ -0,0 +1,53 @@
+package broker
+
+import "time"
+
+// Config Broker配置
+type Config struct {
+	// RetryInterval MQTT 3.x未确认的QoS>0消息重发间隔，0表示仅在重连时重发，MQTT 5始终仅在重连时重发
+	RetryInterval time.Duration
+	// MaxInflight 每个会话未确认的QoS>0消息数量上限
+	MaxInflight int
+	// MaxQueuedMessages 每个会话等待发送的消息数量上限
+	MaxQueuedMessages int
+	// ClientIDPrefix 为空ClientID的清理会话连接分配ClientID时使用的前缀
+	ClientIDPrefix string
+	// SysInterval $SYS主题的发布间隔，0表示不发布
+	SysInterval time.Duration
+	// SharedStrategy 共享订阅的成员选择策略
+	SharedStrategy SharedStrategy
+	// TopicAliasMaximum MQTT 5.0客户端发布时可使用的主题别名数量，0表示不支持
+	TopicAliasMaximum uint16
+	// ReceiveMaximum MQTT 5.0客户端未完成的QoS 2发布数量上限，0表示不限制
+	ReceiveMaximum uint16
+	// MaxPacketSize 接收报文的最大长度，0表示不限制
+	MaxPacketSize uint32
+	// ResponseTopicPrefix 响应主题前缀，客户端请求时以<前缀>/<ClientID>/作为Response Information返回
+	// 其他客户端不能订阅该命名空间，覆盖它的通配符订阅（包括#）也会被拒绝，空表示不提供
+	ResponseTopicPrefix string
+	// CertClientID 使用客户端证书中的字段作为ClientID，仅对提供了证书的TLS连接生效
+	// 没有证书的连接不能使用已由证书指定过的ClientID，但无法阻止设备首次连接前被抢占，
+	// 依赖证书身份时应关闭明文监听并要求客户端证书
+	CertClientID CertIdentity
+	// CertUsername 使用客户端证书中的字段作为用户名，仅对提供了证书的TLS连接生效
+	CertUsername CertIdentity
+	// RetainedMessageTTL 3.1/3.1.1客户端发布的保留消息的保留时间，0表示永久保留
+	RetainedMessageTTL time.Duration
+	// ExpiryCheckInterval 清理过期保留消息和排队消息的间隔，0表示不清理
+	ExpiryCheckInterval time.Duration
+}
+
+// DefaultConfig 返回默认配置
+func DefaultConfig() *Config {
+	return &Config{
+		RetryInterval:       20 * time.Second,
+		MaxInflight:         100,
+		MaxQueuedMessages:   1000,
+		ClientIDPrefix:      "auto-",
+		SysInterval:         10 * time.Second,
+		SharedStrategy:      SharedRoundRobin,
+		TopicAliasMaximum:   10,
+		ReceiveMaximum:      100,
+		ExpiryCheckInterval: time.Minute,
+	}
+}
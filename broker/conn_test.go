@@ -0,0 +1,198 @@
+package broker
+
+import (
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"busy-cloud/gnet-mqtt/mqtt"
+)
+
+// testConn 记录Broker写出的每个报文的types.Conn
+type testConn struct {
+	written chan []byte
+	closed  chan struct{}
+	once    sync.Once
+	writing sync.Mutex // 持有时Write阻塞，模拟对端不读取
+}
+
+func newTestConn() *testConn {
+	return &testConn{
+		written: make(chan []byte, 1024),
+		closed:  make(chan struct{}),
+	}
+}
+
+func (c *testConn) Read(b []byte) (int, error) {
+	return 0, io.EOF
+}
+
+func (c *testConn) Write(b []byte) (int, error) {
+	c.writing.Lock()
+	defer c.writing.Unlock()
+	c.written <- append([]byte(nil), b...)
+	return len(b), nil
+}
+
+func (c *testConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return nil
+}
+
+func (c *testConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 50000}
+}
+
+// newTestManager 创建不输出日志的Manager
+func newTestManager(config *Config) *Manager {
+	return NewManagerWithConfig(config, slog.New(slog.NewTextHandler(io.Discard, nil)))
+}
+
+// testClient 通过Manager.HandlePacket驱动的客户端，按收到的报文断言Broker的行为
+type testClient struct {
+	t       *testing.T
+	m       *Manager
+	conn    *testConn
+	version byte
+}
+
+// newTestClient 建立传输层连接，尚未发送CONNECT
+func newTestClient(t *testing.T, m *Manager, version byte) *testClient {
+	t.Helper()
+	c := &testClient{t: t, m: m, conn: newTestConn(), version: version}
+	m.AddClient(c.conn, "test")
+	return c
+}
+
+// connectClient 以指定ClientID连接并确认CONNACK成功，返回会话是否存在
+func connectClient(t *testing.T, m *Manager, version byte, clientID string, clean bool, props *mqtt.Properties) (*testClient, bool) {
+	t.Helper()
+	c := newTestClient(t, m, version)
+	c.send(&mqtt.ConnectPacket{
+		ProtocolName:  []byte("MQTT"),
+		ProtocolLevel: version,
+		CleanSession:  clean,
+		ClientID:      []byte(clientID),
+		Properties:    props,
+	})
+	connAck := c.expect(mqtt.CONNACK)
+	if connAck[3] != mqtt.ReasonSuccess {
+		t.Fatalf("%s: CONNACK return code 0x%02x", clientID, connAck[3])
+	}
+	return c, connAck[2]&0x01 != 0
+}
+
+// send 交给Broker处理一个客户端报文
+func (c *testClient) send(packet interface{}) {
+	c.m.HandlePacket(c.conn, packet)
+}
+
+// next 等待Broker写出的下一个报文
+func (c *testClient) next() []byte {
+	c.t.Helper()
+	select {
+	case data := <-c.conn.written:
+		return data
+	case <-time.After(3 * time.Second):
+		c.t.Fatal("timed out waiting for packet")
+		return nil
+	}
+}
+
+// expect 等待下一个报文并确认其类型
+func (c *testClient) expect(packetType byte) []byte {
+	c.t.Helper()
+	data := c.next()
+	if data[0]>>4 != packetType {
+		c.t.Fatalf("got packet type %d (% x), want %d", data[0]>>4, data, packetType)
+	}
+	return data
+}
+
+// decode 等待下一个报文，确认类型后按连接的协议版本解析
+func (c *testClient) decode(packetType byte) interface{} {
+	c.t.Helper()
+	packet, err := mqtt.DecodePacket(c.expect(packetType), c.version)
+	if err != nil {
+		c.t.Fatalf("decode packet type %d: %v", packetType, err)
+	}
+	return packet
+}
+
+// expectPublish 等待下一个PUBLISH报文，确认主题、载荷、QoS和DUP标志
+func (c *testClient) expectPublish(topic, payload string, qos byte, dup bool) *mqtt.PublishPacket {
+	c.t.Helper()
+	p := c.decode(mqtt.PUBLISH).(*mqtt.PublishPacket)
+	if string(p.TopicName) != topic || string(p.Payload) != payload || p.QoS != qos || p.Dup != dup {
+		c.t.Fatalf("got PUBLISH %s %q qos=%d dup=%v, want %s %q qos=%d dup=%v",
+			p.TopicName, p.Payload, p.QoS, p.Dup, topic, payload, qos, dup)
+	}
+	return p
+}
+
+// expectNone 确认短时间内没有写出报文
+func (c *testClient) expectNone() {
+	c.t.Helper()
+	c.expectNoneFor(50 * time.Millisecond)
+}
+
+// expectNoneFor 确认d时间内没有写出报文
+func (c *testClient) expectNoneFor(d time.Duration) {
+	c.t.Helper()
+	select {
+	case data := <-c.conn.written:
+		c.t.Fatalf("unexpected packet % x", data)
+	case <-time.After(d):
+	}
+}
+
+// expectClosed 等待Broker关闭连接
+func (c *testClient) expectClosed() {
+	c.t.Helper()
+	select {
+	case <-c.conn.closed:
+	case <-time.After(time.Second):
+		c.t.Fatal("connection not closed")
+	}
+}
+
+// subscribe 订阅并确认SUBACK授予的QoS
+func (c *testClient) subscribe(packetID uint16, filter string, qos byte) {
+	c.t.Helper()
+	c.send(&mqtt.SubscribePacket{
+		PacketID: packetID,
+		Topics:   []mqtt.SubscribeTopic{{TopicFilter: []byte(filter), QoS: qos}},
+	})
+	subAck := c.expect(mqtt.SUBACK)
+	if got := subAck[len(subAck)-1]; got != qos {
+		c.t.Fatalf("SUBACK %s = 0x%02x, want %d", filter, got, qos)
+	}
+}
+
+// publish 发布QoS 0消息
+func (c *testClient) publish(topic, payload string) {
+	c.send(&mqtt.PublishPacket{TopicName: []byte(topic), Payload: []byte(payload)})
+}
+
+// publishQoS1 发布QoS 1消息并确认收到PUBACK
+func (c *testClient) publishQoS1(packetID uint16, topic, payload string) {
+	c.t.Helper()
+	c.send(&mqtt.PublishPacket{TopicName: []byte(topic), Payload: []byte(payload), QoS: 1, PacketID: packetID})
+	if ack := c.decode(mqtt.PUBACK).(*mqtt.PubAckPacket); ack.PacketID != packetID {
+		c.t.Fatalf("PUBACK for %d, want %d", ack.PacketID, packetID)
+	}
+}
+
+// disconnect 正常断开连接并移除客户端
+func (c *testClient) disconnect() {
+	c.send(&mqtt.DisconnectPacket{})
+	c.m.RemoveClient(c.conn)
+}
+
+// drop 不发送DISCONNECT直接移除客户端，模拟网络断开
+func (c *testClient) drop() {
+	c.m.RemoveClient(c.conn)
+}
@@ -0,0 +1,39 @@
+package broker
+
+import (
+	"context"
+	"time"
+)
+
+// runExpirySweeper 定期清理过期的保留消息和会话中排队的消息
+func (m *Manager) runExpirySweeper(ctx context.Context) {
+	ticker := time.NewTicker(m.config.ExpiryCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			m.sweepExpired()
+		}
+	}
+}
+
+// sweepExpired 删除已过期的保留消息并丢弃排队中已过期的消息
+func (m *Manager) sweepExpired() {
+	now := time.Now()
+	retained := m.router.RemoveExpiredRetained()
+
+	queued := 0
+	m.sessions.Range(func(key, value interface{}) bool {
+		queued += value.(*ClientSession).dropExpired(now)
+		return true
+	})
+
+	if retained > 0 || queued > 0 {
+		m.logger.Debug("Expired messages removed",
+			"retained", retained,
+			"queued", queued)
+	}
+}
@@ -1,7 +1,13 @@
 package broker
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
 	"log/slog"
+	"math"
 	"sync"
 	"time"
 
@@ -11,29 +17,140 @@ import (
 
 // Manager Broker管理器
 type Manager struct {
-	clients  sync.Map // map[types.Conn]*ClientContext
-	sessions sync.Map // map[string]*ClientSession
-	router   *Router
-	mu       sync.RWMutex
-	logger   *slog.Logger
+	clients   sync.Map // map[types.Conn]*ClientContext
+	sessions  sync.Map // map[string]*ClientSession
+	router    *Router
+	config    *Config
+	stats     stats
+	scheduler *scheduler // 遗嘱延迟与会话过期
+	mu        sync.RWMutex
+	logger    *slog.Logger
+
+	authenticators map[string]Authenticator // 认证方法名 -> 增强认证方法
+	redirect       *redirection             // 重定向或关闭时不为nil
+	certClientIDs  sync.Map                 // 由客户端证书指定过的ClientID
 }
 
 // ClientContext 客户端上下文
 type ClientContext struct {
 	Client     *types.Client
+	Conn       types.Conn
 	LastActive time.Time
 	SendChan   chan []byte
+
+	session *ClientSession
+	aliases *topicAliases
+	// 客户端的接收限制：未确认的QoS>0消息数量及最大报文长度（0表示不限制）
+	receiveMaximum int
+	maxPacketSize  uint32
+	// ClientID由服务端分配或取自客户端证书
+	clientIDAssigned bool
+	auth             *authState // 进行中的增强认证
+	authMethod       string     // 建立连接时使用的增强认证方法
+	mu               sync.RWMutex
+	closed           bool
+}
+
+// closeMarker 发送队列中的关闭标记，发送循环收到后关闭连接
+var closeMarker = []byte{}
+
+// send 将数据放入发送队列，连接已关闭或队列已满时返回false
+func (c *ClientContext) send(data []byte) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if c.closed {
+		return false
+	}
+
+	select {
+	case c.SendChan <- data:
+		return true
+	default:
+		return false
+	}
+}
+
+// sendAndClose 发送最后一个报文后关闭连接
+func (c *ClientContext) sendAndClose(data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return
+	}
+	c.closed = true
+
+	// 持有写锁时没有其他发送者，队列能同时容纳报文和关闭标记时才发送，否则直接关闭连接
+	if cap(c.SendChan)-len(c.SendChan) >= 2 {
+		c.SendChan <- data
+		c.SendChan <- closeMarker
+	} else {
+		c.Conn.Close()
+	}
+	close(c.SendChan)
+}
+
+// isClosed 发送队列是否已关闭
+func (c *ClientContext) isClosed() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.closed
 }
 
-// NewManager 创建新的管理器
+// close 关闭发送队列
+func (c *ClientContext) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !c.closed {
+		c.closed = true
+		close(c.SendChan)
+	}
+}
+
+// NewManager 使用默认配置创建新的管理器
 func NewManager(logger *slog.Logger) *Manager {
+	return NewManagerWithConfig(DefaultConfig(), logger)
+}
+
+// NewManagerWithConfig 使用指定配置创建新的管理器
+func NewManagerWithConfig(config *Config, logger *slog.Logger) *Manager {
 	if logger == nil {
 		logger = slog.Default()
 	}
-	return &Manager{
-		router: NewRouter(logger),
-		logger: logger,
+	if config == nil {
+		config = DefaultConfig()
 	}
+	m := &Manager{
+		router:    NewRouter(logger),
+		config:    config,
+		scheduler: newScheduler(),
+		logger:    logger,
+	}
+	m.stats.startTime = time.Now()
+	m.router.SetDeliverFunc(m.deliver)
+	m.router.SetSharedStrategy(config.SharedStrategy)
+	m.router.SetRetainedTTL(config.RetainedMessageTTL)
+	m.router.setSubscriberStatus(m)
+	return m
+}
+
+// Start 启动管理器的后台任务，ctx取消时退出
+// 未启动时延迟的遗嘱消息不会发布，持久会话不会过期
+func (m *Manager) Start(ctx context.Context) {
+	go m.scheduler.run(ctx)
+	if m.config.SysInterval > 0 {
+		go m.runSysPublisher(ctx)
+	}
+	if m.config.ExpiryCheckInterval > 0 {
+		go m.runExpirySweeper(ctx)
+	}
+}
+
+// AddBytesReceived 累计从客户端收到的字节数
+func (m *Manager) AddBytesReceived(n int) {
+	m.stats.bytesReceived.Add(int64(n))
 }
 
 // AddClient 添加客户端
@@ -44,6 +161,7 @@ func (m *Manager) AddClient(conn types.Conn, connType string) {
 			Connected: false,
 			ConnType:  connType,
 		},
+		Conn:       conn,
 		LastActive: time.Now(),
 		SendChan:   make(chan []byte, 100),
 	}
@@ -60,22 +178,16 @@ func (m *Manager) AddClient(conn types.Conn, connType string) {
 // RemoveClient 移除客户端
 func (m *Manager) RemoveClient(conn types.Conn) {
 	if clientCtx, ok := m.clients.Load(conn); ok {
-		close(clientCtx.(*ClientContext).SendChan)
+		clientCtx.(*ClientContext).close()
 
 		if clientCtx.(*ClientContext).Client.Connected {
-			clientID := string(clientCtx.(*ClientContext).Client.ClientID)
-			m.router.UnsubscribeAll(clientID)
+			released, ended := m.releaseSession(clientCtx.(*ClientContext))
+			if released {
+				m.failoverShared(clientCtx.(*ClientContext).session)
+			}
 
 			// 发布遗嘱消息
-			if clientCtx.(*ClientContext).Client.WillMessage != nil {
-				message := &types.Message{
-					Topic:   clientCtx.(*ClientContext).Client.WillMessage.Topic,
-					Payload: clientCtx.(*ClientContext).Client.WillMessage.Payload,
-					QoS:     clientCtx.(*ClientContext).Client.WillMessage.QoS,
-					Retain:  clientCtx.(*ClientContext).Client.WillMessage.Retain,
-				}
-				m.router.RouteMessage(message)
-			}
+			m.dispatchWill(clientCtx.(*ClientContext), ended)
 		}
 
 		m.clients.Delete(conn)
@@ -87,6 +199,11 @@ func (m *Manager) RemoveClient(conn types.Conn) {
 // sendLoop 发送消息循环
 func (m *Manager) sendLoop(conn types.Conn, clientCtx *ClientContext) {
 	for data := range clientCtx.SendChan {
+		if len(data) == 0 {
+			conn.Close()
+			break
+		}
+
 		_, err := conn.Write(data)
 		if err != nil {
 			m.logger.Error("Failed to send data to client",
@@ -94,7 +211,42 @@ func (m *Manager) sendLoop(conn types.Conn, clientCtx *ClientContext) {
 				"remote_addr", conn.RemoteAddr().String())
 			break
 		}
+
+		m.stats.bytesSent.Add(int64(len(data)))
+		if data[0]>>4 == mqtt.PUBLISH {
+			m.stats.messagesSent.Add(1)
+		}
+	}
+}
+
+// ProtocolVersion 获取连接协商的协议版本，CONNECT之前返回0
+func (m *Manager) ProtocolVersion(conn types.Conn) byte {
+	if clientCtx, ok := m.clients.Load(conn); ok {
+		return clientCtx.(*ClientContext).Client.ProtocolVersion
+	}
+	return 0
+}
+
+// MaxPacketSize 接收报文的最大长度，0表示不限制
+func (m *Manager) MaxPacketSize() int {
+	return int(m.config.MaxPacketSize)
+}
+
+// AcceptPacketSize 检查收到的报文长度，超过MaxPacketSize时断开连接并返回false
+func (m *Manager) AcceptPacketSize(conn types.Conn, size int) bool {
+	if m.config.MaxPacketSize == 0 || uint32(size) <= m.config.MaxPacketSize {
+		return true
+	}
+
+	m.logger.Warn("Packet too large, closing connection",
+		"remote_addr", conn.RemoteAddr().String(),
+		"size", size)
+	if clientCtx, ok := m.clients.Load(conn); ok && clientCtx.(*ClientContext).Client.Connected {
+		m.disconnect(clientCtx.(*ClientContext), mqtt.ReasonPacketTooLarge)
+	} else {
+		conn.Close()
 	}
+	return false
 }
 
 // HandlePacket 处理MQTT报文
@@ -104,28 +256,62 @@ func (m *Manager) HandlePacket(conn types.Conn, packet interface{}) {
 		return
 	}
 
+	// 已被接管的连接不再处理后续报文
+	if clientCtx.(*ClientContext).isClosed() {
+		return
+	}
+
 	clientCtx.(*ClientContext).LastActive = time.Now()
 
+	// 连接建立前只允许CONNECT及增强认证中的AUTH，重复的CONNECT视为协议错误
+	connected := clientCtx.(*ClientContext).Client.Connected
+	var allowed bool
+	switch packet.(type) {
+	case *mqtt.ConnectPacket:
+		allowed = !connected && clientCtx.(*ClientContext).auth == nil
+	case *mqtt.AuthPacket:
+		allowed = connected || clientCtx.(*ClientContext).auth != nil
+	default:
+		allowed = connected
+	}
+	if !allowed {
+		m.logger.Warn("Protocol violation, closing connection",
+			"remote_addr", conn.RemoteAddr().String(),
+			"connected", clientCtx.(*ClientContext).Client.Connected)
+		conn.Close()
+		return
+	}
+
 	var response []byte
 	switch p := packet.(type) {
 	case *mqtt.ConnectPacket:
 		response = m.handleConnect(clientCtx.(*ClientContext), p)
 	case *mqtt.PublishPacket:
 		response = m.handlePublish(clientCtx.(*ClientContext), p)
+	case *mqtt.PubAckPacket:
+		m.handlePubAck(clientCtx.(*ClientContext), p)
+	case *mqtt.PubRecPacket:
+		m.handlePubRec(clientCtx.(*ClientContext), p)
+	case *mqtt.PubRelPacket:
+		response = m.handlePubRel(clientCtx.(*ClientContext), p)
+	case *mqtt.PubCompPacket:
+		m.handlePubComp(clientCtx.(*ClientContext), p)
 	case *mqtt.SubscribePacket:
 		response = m.handleSubscribe(clientCtx.(*ClientContext), p)
+	case *mqtt.UnsubscribePacket:
+		response = m.handleUnsubscribe(clientCtx.(*ClientContext), p)
 	case *mqtt.PingReqPacket:
 		response = m.handlePingReq(clientCtx.(*ClientContext))
 	case *mqtt.DisconnectPacket:
-		m.handleDisconnect(clientCtx.(*ClientContext))
+		m.handleDisconnect(clientCtx.(*ClientContext), p)
+	case *mqtt.AuthPacket:
+		m.handleAuth(clientCtx.(*ClientContext), p)
 	default:
 		m.logger.Warn("Unknown packet type received")
 	}
 
 	if response != nil {
-		select {
-		case clientCtx.(*ClientContext).SendChan <- response:
-		default:
+		if !clientCtx.(*ClientContext).send(response) {
 			m.logger.Warn("Send channel full, dropping packet")
 		}
 	}
@@ -134,78 +320,683 @@ func (m *Manager) HandlePacket(conn types.Conn, packet interface{}) {
 // handleConnect 处理连接请求
 func (m *Manager) handleConnect(clientCtx *ClientContext, p *mqtt.ConnectPacket) []byte {
 	// 验证协议
-	if string(p.ProtocolName) != "MQTT" || p.ProtocolLevel != 4 {
-		return mqtt.CreateConnAck(false, 1)
+	version := p.ProtocolLevel
+	if !supportedProtocol(p.ProtocolName, version) {
+		m.refuseConnect(clientCtx, mqtt.Version311, mqtt.ReasonUnsupportedProtocolVersion, nil)
+		return nil
+	}
+
+	// 使用客户端证书中的身份
+	if !m.applyCertIdentity(clientCtx, p) {
+		m.refuseConnect(clientCtx, version, mqtt.ReasonNotAuthorized, nil)
+		return nil
 	}
 
-	// 验证ClientID
-	if len(p.ClientID) == 0 && !p.CleanSession {
-		return mqtt.CreateConnAck(false, 2)
+	// 验证ClientID，MQTT 3.1要求长度为1-23字节，MQTT 3.1.1要求空ClientID必须使用清理会话
+	invalidID := len(p.ClientID) == 0 && !p.CleanSession && version == mqtt.Version311
+	if version == mqtt.Version31 {
+		invalidID = len(p.ClientID) == 0 || len(p.ClientID) > maxClientIDLength31
+	}
+	if invalidID {
+		m.refuseConnect(clientCtx, version, mqtt.ReasonClientIdentifierNotValid, nil)
+		return nil
+	}
+	clientCtx.Client.ProtocolVersion = version
+
+	// 重定向或关闭期间拒绝新连接
+	if r, ok := m.redirection(); ok {
+		m.refuseConnect(clientCtx, version, r.reasonCode, r.properties())
+		return nil
+	}
+
+	// Receive Maximum和Maximum Packet Size为0是协议错误
+	if props := p.Properties; props != nil &&
+		((props.ReceiveMaximum != nil && *props.ReceiveMaximum == 0) ||
+			(props.MaximumPacketSize != nil && *props.MaximumPacketSize == 0)) {
+		m.refuseConnect(clientCtx, version, mqtt.ReasonProtocolError, nil)
+		return nil
+	}
+
+	// 请求增强认证时先完成认证交换
+	if version == mqtt.Version5 && p.Properties != nil && p.Properties.AuthenticationMethod != nil {
+		m.startConnectAuth(clientCtx, p)
+		return nil
+	}
+
+	m.completeConnect(clientCtx, p, nil)
+	return nil
+}
+
+// completeConnect 认证通过后建立连接，authProps为增强认证在CONNACK中返回的属性
+func (m *Manager) completeConnect(clientCtx *ClientContext, p *mqtt.ConnectPacket, authProps *mqtt.Properties) {
+	version := p.ProtocolLevel
+
+	var connAckProps *mqtt.Properties
+	var inboundAliasMax, outboundAliasMax uint16
+	clientCtx.receiveMaximum = m.config.MaxInflight
+	if version == mqtt.Version5 {
+		connAckProps = &mqtt.Properties{
+			SubscriptionIdentifierAvailable: mqtt.Byte(1),
+		}
+		if m.config.ReceiveMaximum > 0 {
+			connAckProps.ReceiveMaximum = mqtt.Uint16(m.config.ReceiveMaximum)
+		}
+		if m.config.MaxPacketSize > 0 {
+			connAckProps.MaximumPacketSize = mqtt.Uint32(m.config.MaxPacketSize)
+		}
+		if p.Properties != nil && p.Properties.ReceiveMaximum != nil {
+			clientCtx.receiveMaximum = min(clientCtx.receiveMaximum, int(*p.Properties.ReceiveMaximum))
+		}
+		if p.Properties != nil && p.Properties.MaximumPacketSize != nil {
+			clientCtx.maxPacketSize = *p.Properties.MaximumPacketSize
+		}
+		if m.config.TopicAliasMaximum > 0 {
+			inboundAliasMax = m.config.TopicAliasMaximum
+			connAckProps.TopicAliasMaximum = mqtt.Uint16(inboundAliasMax)
+		}
+		if p.Properties != nil && p.Properties.TopicAliasMaximum != nil {
+			outboundAliasMax = *p.Properties.TopicAliasMaximum
+		}
+		if authProps != nil {
+			connAckProps.AuthenticationMethod = authProps.AuthenticationMethod
+			connAckProps.AuthenticationData = authProps.AuthenticationData
+		}
+	}
+	clientCtx.aliases = newTopicAliases(inboundAliasMax, outboundAliasMax)
+
+	// 空ClientID由服务端分配，MQTT 5.0通过CONNACK告知客户端
+	if len(p.ClientID) == 0 {
+		p.ClientID = m.assignClientID()
+		clientCtx.clientIDAssigned = true
+	}
+	if connAckProps != nil && clientCtx.clientIDAssigned {
+		connAckProps.AssignedClientIdentifier = p.ClientID
+	}
+
+	// 客户端请求响应信息时返回其专用的响应主题前缀
+	if connAckProps != nil && p.Properties != nil && p.Properties.RequestResponseInformation != nil &&
+		*p.Properties.RequestResponseInformation == 1 {
+		if namespace := m.responseNamespace(p.ClientID); namespace != "" {
+			connAckProps.ResponseInformation = []byte(namespace)
+		}
 	}
 
 	// 设置客户端信息 - 直接使用字节数组
 	clientCtx.Client.ClientID = p.ClientID
+	clientCtx.Client.Username = p.Username
 	clientCtx.Client.CleanSession = p.CleanSession
 	clientCtx.Client.KeepAlive = p.KeepAlive
+	clientCtx.Client.SessionExpiryInterval = sessionExpiryInterval(p)
 	clientCtx.Client.Connected = true
 
 	// 设置遗嘱消息 - 直接使用字节数组
 	if p.WillFlag {
 		clientCtx.Client.WillMessage = &types.WillMessage{
-			Topic:   p.WillTopic,
-			Payload: p.WillMessage,
-			QoS:     p.WillQoS,
-			Retain:  p.WillRetain,
+			Topic:      p.WillTopic,
+			Payload:    p.WillMessage,
+			QoS:        p.WillQoS,
+			Retain:     p.WillRetain,
+			Properties: p.WillProperties,
 		}
 	}
 
 	m.logger.Info("Client connected successfully",
 		"client_id", string(p.ClientID),
+		"protocol_version", version,
 		"clean_session", p.CleanSession)
 
-	return mqtt.CreateConnAck(false, 0)
+	sessionPresent, evicted := m.acquireSession(clientCtx)
+	if evicted != nil {
+		m.evictClient(evicted, sessionPresent)
+	} else {
+		m.stats.clientsConnected.Add(1)
+	}
+
+	// CONNACK必须先于重发的消息发送
+	if !clientCtx.send(mqtt.CreateConnAck(version, sessionPresent, mqtt.ReasonSuccess, connAckProps)) {
+		m.logger.Warn("Send channel full, dropping packet")
+		return
+	}
+	clientCtx.session.resume()
+}
+
+// disconnect 服务端主动断开连接，MQTT 5.0客户端先收到携带原因码的DISCONNECT
+func (m *Manager) disconnect(clientCtx *ClientContext, reasonCode byte) {
+	m.sendDisconnect(clientCtx, reasonCode, nil)
+}
+
+// sendDisconnect 服务端主动断开连接，MQTT 5.0的DISCONNECT携带原因码和属性
+func (m *Manager) sendDisconnect(clientCtx *ClientContext, reasonCode byte, props *mqtt.Properties) {
+	if clientCtx.Client.ProtocolVersion == mqtt.Version5 {
+		clientCtx.sendAndClose(mqtt.CreateDisconnect(mqtt.Version5, reasonCode, props))
+		return
+	}
+	clientCtx.close()
+	clientCtx.Conn.Close()
+}
+
+// maxClientIDLength31 MQTT 3.1 ClientID的最大长度
+const maxClientIDLength31 = 23
+
+// supportedProtocol 校验协议名与协议级别的组合
+func supportedProtocol(name []byte, level byte) bool {
+	switch string(name) {
+	case "MQIsdp":
+		return level == mqtt.Version31
+	case "MQTT":
+		return level == mqtt.Version311 || level == mqtt.Version5
+	}
+	return false
+}
+
+// refuseConnect 发送拒绝连接的CONNACK并关闭连接，props仅用于MQTT 5.0
+func (m *Manager) refuseConnect(clientCtx *ClientContext, version byte, reasonCode byte, props *mqtt.Properties) {
+	m.logger.Warn("Connection refused",
+		"remote_addr", clientCtx.Conn.RemoteAddr().String(),
+		"protocol_version", version,
+		"reason_code", reasonCode)
+
+	clientCtx.sendAndClose(mqtt.CreateConnAck(version, false, mqtt.ConnAckCode(version, reasonCode), props))
+}
+
+// sessionExpiryInterval 计算会话过期间隔
+// MQTT 3.1.1清理会话为0，持久会话永不过期；MQTT 5.0使用CONNECT中的属性
+func sessionExpiryInterval(p *mqtt.ConnectPacket) uint32 {
+	if p.ProtocolLevel != mqtt.Version5 {
+		if p.CleanSession {
+			return 0
+		}
+		return math.MaxUint32
+	}
+	if p.Properties != nil && p.Properties.SessionExpiryInterval != nil {
+		return *p.Properties.SessionExpiryInterval
+	}
+	return 0
 }
 
 // handlePublish 处理发布消息
 func (m *Manager) handlePublish(clientCtx *ClientContext, p *mqtt.PublishPacket) []byte {
+	topic, reasonCode := clientCtx.aliases.resolve(p.TopicName, p.Properties)
+	if reasonCode != mqtt.ReasonSuccess {
+		m.logger.Warn("Invalid topic alias, closing connection",
+			"client_id", string(clientCtx.Client.ClientID),
+			"reason_code", reasonCode)
+		m.disconnect(clientCtx, reasonCode)
+		return nil
+	}
+
 	message := &types.Message{
-		Topic:    p.TopicName,
-		Payload:  p.Payload,
-		QoS:      p.QoS,
-		Retain:   p.Retain,
-		PacketID: p.PacketID,
+		Topic:       topic,
+		Payload:     p.Payload,
+		QoS:         p.QoS,
+		Retain:      p.Retain,
+		PacketID:    p.PacketID,
+		PublisherID: clientCtx.Client.ClientID,
+		Properties:  p.Properties,
+	}
+	if p.Properties != nil && p.Properties.MessageExpiryInterval != nil {
+		message.ExpiresAt = time.Now().Add(time.Duration(*p.Properties.MessageExpiryInterval) * time.Second)
 	}
+	version := clientCtx.Client.ProtocolVersion
 
-	m.router.RouteMessage(message)
+	m.stats.messagesReceived.Add(1)
+
+	// QoS 2在收到PUBREL之前，重复的报文标识符不再路由
+	if p.QoS == 2 {
+		limit := 0
+		if version == mqtt.Version5 {
+			limit = int(m.config.ReceiveMaximum)
+		}
+		first, exceeded := clientCtx.session.receive(p.PacketID, limit)
+		if exceeded {
+			m.logger.Warn("Receive maximum exceeded, closing connection",
+				"client_id", string(clientCtx.Client.ClientID))
+			m.disconnect(clientCtx, mqtt.ReasonReceiveMaximumExceeded)
+			return nil
+		}
+		if !first {
+			m.logger.Debug("Duplicate QoS 2 message ignored",
+				"client_id", string(clientCtx.Client.ClientID),
+				"packet_id", p.PacketID)
+			return mqtt.CreatePubRec(version, p.PacketID, mqtt.ReasonSuccess, nil)
+		}
+	}
+
+	// 客户端不能发布系统状态主题，消息丢弃但仍正常确认
+	if bytes.HasPrefix(topic, []byte(sysTopicRoot)) {
+		m.logger.Warn("Client publish to $SYS topic ignored",
+			"client_id", string(clientCtx.Client.ClientID),
+			"topic", string(topic))
+	} else if m.router.RouteMessage(message) == 0 {
+		reasonCode = mqtt.ReasonNoMatchingSubscribers
+	}
 
 	m.logger.Debug("Message published",
 		"topic", string(p.TopicName),
 		"qos", p.QoS,
 		"payload_size", len(p.Payload))
 
-	// QoS 1需要回复PUBACK
-	if p.QoS == 1 {
-		return m.createPubAck(p.PacketID)
+	switch p.QoS {
+	case 1:
+		return mqtt.CreatePubAck(version, p.PacketID, reasonCode, nil)
+	case 2:
+		return mqtt.CreatePubRec(version, p.PacketID, reasonCode, nil)
 	}
 
 	return nil
 }
 
+// handlePubRel 处理发布者的PUBREL，释放报文标识符并回复PUBCOMP
+func (m *Manager) handlePubRel(clientCtx *ClientContext, p *mqtt.PubRelPacket) []byte {
+	reasonCode := byte(mqtt.ReasonSuccess)
+	if !clientCtx.session.release(p.PacketID) {
+		m.logger.Debug("PUBREL for unknown packet id",
+			"client_id", string(clientCtx.Client.ClientID),
+			"packet_id", p.PacketID)
+		reasonCode = mqtt.ReasonPacketIdentifierNotFound
+	}
+	return mqtt.CreatePubComp(clientCtx.Client.ProtocolVersion, p.PacketID, reasonCode, nil)
+}
+
+// assignClientID 生成未被占用的ClientID
+func (m *Manager) assignClientID() []byte {
+	buf := make([]byte, 8)
+	for {
+		rand.Read(buf)
+		clientID := m.config.ClientIDPrefix + hex.EncodeToString(buf)
+		if _, exists := m.sessions.Load(clientID); !exists {
+			return []byte(clientID)
+		}
+	}
+}
+
+// acquireSession 为连接获取会话，返回是否恢复了已有会话及被接管的旧连接
+// 新连接到来时取消会话过期；会话被恢复时取消延迟的遗嘱，否则旧会话结束，立即发布遗嘱
+func (m *Manager) acquireSession(clientCtx *ClientContext) (bool, *ClientContext) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	clientID := string(clientCtx.Client.ClientID)
+	cleanSession := clientCtx.Client.CleanSession
+	m.scheduler.cancel(sessionTaskKey(clientID))
+
+	var evicted *ClientContext
+	if value, ok := m.sessions.Load(clientID); ok {
+		session := value.(*ClientSession)
+
+		// 同一ClientID的旧连接仍在线时由新连接接管
+		evicted = session.takeover()
+
+		if !cleanSession && !session.CleanSession {
+			m.scheduler.cancel(willTaskKey(clientID))
+			session.attach(clientCtx)
+			m.logger.Debug("Session resumed", "client_id", clientID)
+			return true, evicted
+		}
+		// 清理会话连接或旧会话为清理会话时丢弃已有会话及其订阅
+		m.discardSession(session)
+	}
+	m.scheduler.runNow(willTaskKey(clientID))
+
+	session := newClientSession(clientID, cleanSession, m.config)
+	m.sessions.Store(clientID, session)
+	session.attach(clientCtx)
+	return false, evicted
+}
+
+// evictClient 断开被接管的旧连接，会话被新连接恢复且设置了遗嘱延迟时不发布遗嘱，否则立即发布
+func (m *Manager) evictClient(clientCtx *ClientContext, resumed bool) {
+	m.logger.Info("Session taken over, disconnecting existing client",
+		"client_id", string(clientCtx.Client.ClientID),
+		"remote_addr", clientCtx.Conn.RemoteAddr().String())
+
+	m.disconnect(clientCtx, mqtt.ReasonSessionTakenOver)
+	will := m.takeWill(clientCtx)
+	if will != nil && !(resumed && willDelay(clientCtx.Client, will) > 0) {
+		m.routeWill(clientCtx.Client.ClientID, will)
+	}
+}
+
+// takeWill 取出并清除连接的遗嘱消息
+func (m *Manager) takeWill(clientCtx *ClientContext) *types.WillMessage {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	will := clientCtx.Client.WillMessage
+	clientCtx.Client.WillMessage = nil
+	return will
+}
+
+// dispatchWill 处理连接断开后的遗嘱消息，会话仍然存在且设置了遗嘱延迟时延迟发布
+func (m *Manager) dispatchWill(clientCtx *ClientContext, sessionEnded bool) {
+	will := m.takeWill(clientCtx)
+	if will == nil {
+		return
+	}
+
+	clientID := clientCtx.Client.ClientID
+	delay := willDelay(clientCtx.Client, will)
+	if sessionEnded || delay == 0 {
+		m.routeWill(clientID, will)
+		return
+	}
+
+	m.logger.Debug("Will message delayed",
+		"client_id", string(clientID),
+		"delay", delay)
+	m.scheduler.schedule(willTaskKey(string(clientID)), time.Now().Add(delay), func() {
+		m.routeWill(clientID, will)
+	})
+}
+
+// routeWill 发布遗嘱消息
+func (m *Manager) routeWill(clientID []byte, will *types.WillMessage) {
+	m.router.RouteMessage(&types.Message{
+		Topic:       will.Topic,
+		Payload:     will.Payload,
+		QoS:         will.QoS,
+		Retain:      will.Retain,
+		PublisherID: clientID,
+		Properties:  will.Properties,
+	})
+}
+
+// willDelay 遗嘱延迟时间，不超过会话过期间隔
+func willDelay(client *types.Client, will *types.WillMessage) time.Duration {
+	if will.Properties == nil || will.Properties.WillDelayInterval == nil {
+		return 0
+	}
+	delay := min(*will.Properties.WillDelayInterval, client.SessionExpiryInterval)
+	return time.Duration(delay) * time.Second
+}
+
+// releaseSession 解除连接与会话的绑定，会话过期间隔为0时删除会话，否则按间隔安排会话过期
+// 返回是否解除了绑定（连接已被接管时为false）及会话是否已结束
+func (m *Manager) releaseSession(clientCtx *ClientContext) (released bool, ended bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	session := clientCtx.session
+	if session == nil || !session.detach(clientCtx) {
+		return false, false
+	}
+	m.stats.clientsConnected.Add(-1)
+
+	expiry := clientCtx.Client.SessionExpiryInterval
+	switch expiry {
+	case 0:
+		m.discardSession(session)
+		return true, true
+	case math.MaxUint32:
+		// 永不过期
+	default:
+		m.scheduler.schedule(sessionTaskKey(session.ClientID), time.Now().Add(time.Duration(expiry)*time.Second), func() {
+			m.expireSession(session)
+		})
+	}
+	return true, false
+}
+
+// expireSession 删除过期且仍处于离线状态的会话
+func (m *Manager) expireSession(session *ClientSession) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if session.online() {
+		return
+	}
+	m.discardSession(session)
+	m.logger.Info("Session expired", "client_id", session.ClientID)
+}
+
+// willTaskKey 延迟遗嘱任务的调度key
+func willTaskKey(clientID string) string {
+	return "will/" + clientID
+}
+
+// sessionTaskKey 会话过期任务的调度key
+func sessionTaskKey(clientID string) string {
+	return "session/" + clientID
+}
+
+// failoverShared 将断开的共享订阅成员未确认的消息转交给组内其他成员
+func (m *Manager) failoverShared(session *ClientSession) {
+	for _, om := range session.takeShared() {
+		if m.router.RouteShared(om.shareName, om.message, session.ClientID) {
+			continue
+		}
+		// 组内没有其他成员时消息留在原会话
+		if !session.requeue(om) {
+			m.logger.Warn("Shared subscription message dropped",
+				"client_id", session.ClientID,
+				"share_name", om.shareName,
+				"topic", string(om.message.Topic))
+		}
+	}
+}
+
+// isOnline 客户端是否在线
+func (m *Manager) isOnline(clientID string) bool {
+	value, ok := m.sessions.Load(clientID)
+	return ok && value.(*ClientSession).online()
+}
+
+// inflightCount 客户端未确认及等待发送的消息数量
+func (m *Manager) inflightCount(clientID string) int {
+	value, ok := m.sessions.Load(clientID)
+	if !ok {
+		return 0
+	}
+	return value.(*ClientSession).load()
+}
+
+// discardSession 删除会话及其全部订阅，调用方需持有m.mu
+func (m *Manager) discardSession(session *ClientSession) {
+	if m.sessions.CompareAndDelete(session.ClientID, session) {
+		m.router.UnsubscribeAll(session.ClientID)
+		m.logger.Debug("Session discarded", "client_id", session.ClientID)
+	}
+}
+
+// deliver 将路由匹配的消息投递给订阅者
+func (m *Manager) deliver(message *types.Message, delivery *Delivery) {
+	if message.Expired(time.Now()) {
+		m.logger.Debug("Message expired, dropped",
+			"client_id", delivery.ClientID,
+			"topic", string(message.Topic))
+		return
+	}
+
+	value, ok := m.sessions.Load(delivery.ClientID)
+	if !ok {
+		m.logger.Debug("Subscriber has no session, message dropped",
+			"client_id", delivery.ClientID,
+			"topic", string(message.Topic))
+		return
+	}
+
+	// 因已有订阅而转发的消息只在Retain As Published时保留保留标志
+	m.sendPublish(value.(*ClientSession), &outboundMessage{
+		message:         message,
+		qos:             delivery.QoS,
+		retain:          delivery.Retain,
+		shareName:       delivery.ShareName,
+		subscriptionIDs: delivery.SubscriptionIDs,
+	})
+}
+
+// sendPublish 通过会话发送PUBLISH报文
+func (m *Manager) sendPublish(session *ClientSession, om *outboundMessage) {
+	if !session.publish(om) {
+		m.logger.Warn("Message dropped",
+			"client_id", session.ClientID,
+			"topic", string(om.message.Topic),
+			"qos", om.qos)
+
+		// 在线客户端的等待队列已满，处理速度跟不上时断开连接
+		if clientCtx := session.overloaded(); clientCtx != nil {
+			m.logger.Warn("Message queue quota exceeded, disconnecting client",
+				"client_id", session.ClientID)
+			m.disconnect(clientCtx, mqtt.ReasonQuotaExceeded)
+		}
+	}
+}
+
+// handlePubAck 处理订阅者对QoS 1消息的确认
+func (m *Manager) handlePubAck(clientCtx *ClientContext, p *mqtt.PubAckPacket) {
+	if !clientCtx.session.ack(p.PacketID) {
+		m.logger.Debug("PUBACK for unknown packet id",
+			"client_id", string(clientCtx.Client.ClientID),
+			"packet_id", p.PacketID)
+	}
+}
+
+// handlePubRec 处理订阅者对QoS 2消息的PUBREC
+func (m *Manager) handlePubRec(clientCtx *ClientContext, p *mqtt.PubRecPacket) {
+	if !clientCtx.session.rec(p.PacketID) {
+		m.logger.Debug("PUBREC for unknown packet id",
+			"client_id", string(clientCtx.Client.ClientID),
+			"packet_id", p.PacketID)
+	}
+}
+
+// handlePubComp 处理订阅者对QoS 2消息的PUBCOMP
+func (m *Manager) handlePubComp(clientCtx *ClientContext, p *mqtt.PubCompPacket) {
+	if !clientCtx.session.comp(p.PacketID) {
+		m.logger.Debug("PUBCOMP for unknown packet id",
+			"client_id", string(clientCtx.Client.ClientID),
+			"packet_id", p.PacketID)
+	}
+}
+
 // handleSubscribe 处理订阅请求
 func (m *Manager) handleSubscribe(clientCtx *ClientContext, p *mqtt.SubscribePacket) []byte {
 	returnCodes := make([]byte, len(p.Topics))
+	sendRetained := make([]bool, len(p.Topics))
+
+	// 一个SUBSCRIBE最多携带一个订阅标识符，作用于其中所有订阅
+	var subscriptionID uint32
+	if p.Properties != nil && len(p.Properties.SubscriptionIdentifiers) > 0 {
+		if len(p.Properties.SubscriptionIdentifiers) > 1 {
+			m.disconnect(clientCtx, mqtt.ReasonProtocolError)
+			return nil
+		}
+		subscriptionID = p.Properties.SubscriptionIdentifiers[0]
+	}
+
+	version := clientCtx.Client.ProtocolVersion
+	failureCode := byte(mqtt.SubAckFailure)
+	deniedCode := byte(mqtt.SubAckFailure)
+	if version == mqtt.Version5 {
+		failureCode = mqtt.ReasonTopicFilterInvalid
+		deniedCode = mqtt.ReasonNotAuthorized
+	}
 
 	for i, topic := range p.Topics {
-		m.router.Subscribe(string(clientCtx.Client.ClientID), topic.TopicFilter, topic.QoS)
+		// 不允许订阅其他客户端的响应主题
+		if !m.subscribeAllowed(clientCtx.Client.ClientID, topic.TopicFilter) {
+			m.logger.Warn("Subscription not authorized",
+				"client_id", string(clientCtx.Client.ClientID),
+				"topic", string(topic.TopicFilter))
+			if version == mqtt.Version31 {
+				clientCtx.Conn.Close()
+				return nil
+			}
+			returnCodes[i] = deniedCode
+			continue
+		}
+
+		added, err := m.router.Subscribe(string(clientCtx.Client.ClientID), topic.TopicFilter, SubscriptionOptions{
+			QoS:               topic.QoS,
+			NoLocal:           topic.NoLocal,
+			RetainAsPublished: topic.RetainAsPublished,
+			RetainHandling:    topic.RetainHandling,
+			SubscriptionID:    subscriptionID,
+		})
+		if err != nil {
+			m.logger.Warn("Subscription rejected",
+				"client_id", string(clientCtx.Client.ClientID),
+				"topic", string(topic.TopicFilter),
+				"error", err)
+
+			// 共享订阅设置No Local是协议错误
+			if errors.Is(err, ErrSharedNoLocal) {
+				m.disconnect(clientCtx, mqtt.ReasonProtocolError)
+				return nil
+			}
+
+			// MQTT 3.1 的SUBACK没有失败返回码，只能断开连接
+			if version == mqtt.Version31 {
+				clientCtx.Conn.Close()
+				return nil
+			}
+			returnCodes[i] = failureCode
+			continue
+		}
 		returnCodes[i] = topic.QoS
 
+		// 共享订阅不发送保留消息，其余按Retain Handling决定
+		if !bytes.HasPrefix(topic.TopicFilter, []byte(sharePrefix)) {
+			sendRetained[i] = topic.RetainHandling == 0 || (topic.RetainHandling == 1 && added)
+		}
+
 		m.logger.Debug("Client subscribed",
 			"client_id", string(clientCtx.Client.ClientID),
 			"topic", string(topic.TopicFilter),
 			"qos", topic.QoS)
 	}
 
-	return mqtt.CreateSubAck(p.PacketID, returnCodes)
+	// SUBACK必须先于保留消息发送
+	if !clientCtx.send(mqtt.CreateSubAck(version, p.PacketID, returnCodes, nil)) {
+		m.logger.Warn("Send channel full, dropping packet")
+		return nil
+	}
+
+	for i, topic := range p.Topics {
+		if sendRetained[i] {
+			m.sendRetained(clientCtx, topic.TopicFilter, topic.QoS, subscriptionID)
+		}
+	}
+
+	return nil
+}
+
+// sendRetained 向新订阅发送匹配的保留消息
+func (m *Manager) sendRetained(clientCtx *ClientContext, topicFilter []byte, subQoS byte, subscriptionID uint32) {
+	var subscriptionIDs []uint32
+	if subscriptionID != 0 {
+		subscriptionIDs = []uint32{subscriptionID}
+	}
+
+	for _, message := range m.router.MatchRetainedMessages(topicFilter) {
+		qos := message.QoS
+		if subQoS < qos {
+			qos = subQoS
+		}
+		m.sendPublish(clientCtx.session, &outboundMessage{
+			message:         message,
+			qos:             qos,
+			retain:          true,
+			subscriptionIDs: subscriptionIDs,
+		})
+	}
+}
+
+// handleUnsubscribe 处理取消订阅请求
+func (m *Manager) handleUnsubscribe(clientCtx *ClientContext, p *mqtt.UnsubscribePacket) []byte {
+	reasonCodes := make([]byte, len(p.Topics))
+
+	for i, topicFilter := range p.Topics {
+		if !m.router.Unsubscribe(string(clientCtx.Client.ClientID), topicFilter) {
+			reasonCodes[i] = mqtt.ReasonNoSubscriptionExisted
+		}
+
+		m.logger.Debug("Client unsubscribed",
+			"client_id", string(clientCtx.Client.ClientID),
+			"topic", string(topicFilter))
+	}
+
+	return mqtt.CreateUnsubAck(clientCtx.Client.ProtocolVersion, p.PacketID, reasonCodes, nil)
 }
 
 // handlePingReq 处理心跳请求
@@ -213,19 +1004,29 @@ func (m *Manager) handlePingReq(clientCtx *ClientContext) []byte {
 	return mqtt.CreatePingResp()
 }
 
-// handleDisconnect 处理断开连接
-func (m *Manager) handleDisconnect(clientCtx *ClientContext) []byte {
-	clientCtx.Client.Connected = false
-	return nil
-}
+// handleDisconnect 处理断开连接，正常断开时丢弃遗嘱消息
+// MQTT 5.0原因码为0x04时保留遗嘱消息
+func (m *Manager) handleDisconnect(clientCtx *ClientContext, p *mqtt.DisconnectPacket) []byte {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 
-// createPubAck 创建PUBACK包
-func (m *Manager) createPubAck(packetID uint16) []byte {
-	packetIDBuf := make([]byte, 2)
-	packetIDBuf[0] = byte(packetID >> 8)
-	packetIDBuf[1] = byte(packetID)
+	// MQTT 5.0可在断开时修改会话过期间隔，但连接时为0的不能再改为非0
+	if p.Properties != nil && p.Properties.SessionExpiryInterval != nil {
+		expiry := *p.Properties.SessionExpiryInterval
+		if clientCtx.Client.SessionExpiryInterval == 0 && expiry != 0 {
+			m.logger.Warn("Session expiry interval changed from zero on disconnect",
+				"client_id", string(clientCtx.Client.ClientID))
+			m.disconnect(clientCtx, mqtt.ReasonProtocolError)
+			return nil
+		}
+		clientCtx.Client.SessionExpiryInterval = expiry
+		clientCtx.session.setCleanSession(expiry == 0)
+	}
 
-	return mqtt.CreatePacket(mqtt.PUBACK, packetIDBuf)
+	if p.ReasonCode != mqtt.ReasonDisconnectWithWill {
+		clientCtx.Client.WillMessage = nil
+	}
+	return nil
 }
 
 // CheckTimeouts 检查超时连接
@@ -243,7 +1044,21 @@ func (m *Manager) CheckTimeouts() {
 					"client_id", string(clientCtx.Client.ClientID),
 					"remote_addr", conn.RemoteAddr().String())
 
-				conn.Close()
+				m.disconnect(clientCtx, mqtt.ReasonKeepAliveTimeout)
+			}
+		}
+		return true
+	})
+
+	// 补发因发送队列已满未能发出的消息，重发超时未确认的消息
+	m.sessions.Range(func(key, value interface{}) bool {
+		session := value.(*ClientSession)
+		session.deliver()
+		if m.config.RetryInterval > 0 {
+			if n := session.retry(m.config.RetryInterval); n > 0 {
+				m.logger.Debug("Inflight messages retransmitted",
+					"client_id", key.(string),
+					"count", n)
 			}
 		}
 		return true
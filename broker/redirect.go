@@ -0,0 +1,103 @@
+package broker
+
+import (
+	"time"
+
+	"busy-cloud/gnet-mqtt/mqtt"
+)
+
+// shutdownTimeout 关闭时等待客户端收到DISCONNECT并断开的最长时间
+const shutdownTimeout = 5 * time.Second
+
+// redirection 服务端重定向或关闭状态，期间新连接被拒绝
+type redirection struct {
+	reasonCode byte   // ReasonUseAnotherServer、ReasonServerMoved或ReasonServerShuttingDown
+	reference  string // Server Reference，关闭时可为空
+}
+
+// properties MQTT 5.0 CONNACK/DISCONNECT中携带的Server Reference
+func (r *redirection) properties() *mqtt.Properties {
+	if r.reference == "" {
+		return nil
+	}
+	return &mqtt.Properties{ServerReference: []byte(r.reference)}
+}
+
+// Redirect 将客户端重定向到其他服务器，moved为true表示永久迁移
+// 已连接的客户端被断开，新连接被拒绝，MQTT 5.0客户端收到Server Reference；serverReference为空时取消重定向
+func (m *Manager) Redirect(serverReference string, moved bool) {
+	if serverReference == "" {
+		m.mu.Lock()
+		m.redirect = nil
+		m.mu.Unlock()
+		m.logger.Info("Client redirection cancelled")
+		return
+	}
+
+	r := redirection{reasonCode: mqtt.ReasonUseAnotherServer, reference: serverReference}
+	if moved {
+		r.reasonCode = mqtt.ReasonServerMoved
+	}
+	m.mu.Lock()
+	m.redirect = &r
+	m.mu.Unlock()
+
+	m.logger.Info("Redirecting clients",
+		"server_reference", serverReference,
+		"moved", moved)
+	m.disconnectAll(r)
+}
+
+// Shutdown 服务端关闭前断开所有客户端并拒绝新连接，已设置重定向时客户端收到重定向
+// 等待所有连接关闭后返回，最多等待shutdownTimeout
+func (m *Manager) Shutdown() {
+	m.mu.Lock()
+	if m.redirect == nil {
+		m.redirect = &redirection{reasonCode: mqtt.ReasonServerShuttingDown}
+	}
+	r := *m.redirect
+	m.mu.Unlock()
+
+	m.logger.Info("Disconnecting all clients",
+		"reason_code", r.reasonCode)
+	m.disconnectAll(r)
+
+	deadline := time.Now().Add(shutdownTimeout)
+	for m.connectionCount() > 0 && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// connectionCount 当前的连接数量
+func (m *Manager) connectionCount() int {
+	count := 0
+	m.clients.Range(func(key, value interface{}) bool {
+		count++
+		return true
+	})
+	return count
+}
+
+// redirection 返回当前的重定向状态
+func (m *Manager) redirection() (redirection, bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if m.redirect == nil {
+		return redirection{}, false
+	}
+	return *m.redirect, true
+}
+
+// disconnectAll 断开所有连接，已建立MQTT连接的客户端先收到DISCONNECT
+func (m *Manager) disconnectAll(r redirection) {
+	m.clients.Range(func(key, value interface{}) bool {
+		clientCtx := value.(*ClientContext)
+		if clientCtx.Client.Connected {
+			m.sendDisconnect(clientCtx, r.reasonCode, r.properties())
+		} else {
+			clientCtx.Conn.Close()
+		}
+		return true
+	})
+}
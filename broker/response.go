@@ -0,0 +1,52 @@
+package broker
+
+import "strings"
+
+// responseNamespace 客户端的响应主题前缀，未配置ResponseTopicPrefix时返回空
+func (m *Manager) responseNamespace(clientID []byte) string {
+	prefix := m.config.ResponseTopicPrefix
+	if prefix == "" {
+		return ""
+	}
+	if !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+	return prefix + string(clientID) + "/"
+}
+
+// subscribeAllowed 检查订阅是否可能收到其他客户端响应主题命名空间中的消息
+// 写明其他ClientID或以通配符覆盖ClientID层级的过滤器（包括#）都被拒绝，只有写明自己ClientID的过滤器允许
+func (m *Manager) subscribeAllowed(clientID []byte, topicFilter []byte) bool {
+	namespace := m.responseNamespace(clientID)
+	if namespace == "" {
+		return true
+	}
+
+	filter := string(topicFilter)
+	if _, shared, ok := parseSharedFilter(filter); ok {
+		filter = shared
+	}
+
+	// 命名空间中的主题至少比<前缀>/<ClientID>多一层，过滤器层级不够且没有#时匹配不到
+	target := strings.Split(strings.TrimSuffix(namespace, "/"), "/")
+	levels := strings.Split(filter, "/")
+	if len(levels) <= len(target) && levels[len(levels)-1] != "#" {
+		return true
+	}
+
+	prefixLevels := len(target) - len(strings.Split(string(clientID), "/"))
+	for i, level := range target {
+		switch {
+		case levels[i] == "#":
+			return false
+		case i < prefixLevels:
+			// 前缀层级不匹配的过滤器与命名空间无关
+			if levels[i] != "+" && levels[i] != level {
+				return true
+			}
+		case levels[i] != level:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,45 @@
+package broker
+
+import "testing"
+
+func TestSubscribeAllowed(t *testing.T) {
+	config := DefaultConfig()
+	config.ResponseTopicPrefix = "resp"
+	m := NewManagerWithConfig(config, nil)
+
+	tests := []struct {
+		clientID string
+		filter   string
+		allowed  bool
+	}{
+		{"dev1", "resp/dev1/#", true},
+		{"dev1", "resp/dev1/+/status", true},
+		{"dev1", "$share/g/resp/dev1/x", true},
+		{"dev1", "resp/dev2/x", false},
+		{"dev1", "resp/dev2/#", false},
+		{"dev1", "resp/#", false},
+		{"dev1", "resp/+/x", false},
+		{"dev1", "+/+/x", false},
+		{"dev1", "#", false},
+		{"dev1", "$share/g/resp/#", false},
+		{"dev1", "resp", true},
+		{"dev1", "resp/+", true},
+		{"dev1", "+/status", true},
+		{"dev1", "other/#", true},
+		{"dev1", "sensor/+/temp", true},
+		{"a/b", "resp/a/b/x", true},
+		{"a/b", "resp/a/+/x", false},
+		{"a/b", "resp/a/c/x", false},
+	}
+	for _, tt := range tests {
+		if got := m.subscribeAllowed([]byte(tt.clientID), []byte(tt.filter)); got != tt.allowed {
+			t.Errorf("subscribeAllowed(%q, %q) = %v, want %v", tt.clientID, tt.filter, got, tt.allowed)
+		}
+	}
+
+	// 未配置前缀时不限制
+	m = NewManager(nil)
+	if !m.subscribeAllowed([]byte("dev1"), []byte("#")) {
+		t.Error("filter denied without ResponseTopicPrefix")
+	}
+}
@@ -0,0 +1,177 @@
+package broker
+
+import (
+	"strings"
+	"time"
+
+	"busy-cloud/gnet-mqtt/types"
+)
+
+// retainedNode 保留消息树节点，每个节点对应主题的一个层级
+type retainedNode struct {
+	children map[string]*retainedNode
+	message  *types.Message
+}
+
+// retainedStore 按主题层级索引的保留消息存储
+type retainedStore struct {
+	root  *retainedNode
+	count int
+}
+
+func newRetainedStore() *retainedStore {
+	return &retainedStore{root: &retainedNode{}}
+}
+
+// set 设置主题的保留消息
+func (s *retainedStore) set(topic string, message *types.Message) {
+	node := s.root
+	rest, more := topic, true
+	for more {
+		var level string
+		level, rest, more = nextLevel(rest)
+		if node.children == nil {
+			node.children = make(map[string]*retainedNode)
+		}
+		c, ok := node.children[level]
+		if !ok {
+			c = &retainedNode{}
+			node.children[level] = c
+		}
+		node = c
+	}
+
+	if node.message == nil {
+		s.count++
+	}
+	node.message = message
+}
+
+// delete 删除主题的保留消息并清理空节点
+func (s *retainedStore) delete(topic string) {
+	if s.deleteFrom(s.root, topic) {
+		s.count--
+	}
+}
+
+func (s *retainedStore) deleteFrom(node *retainedNode, topic string) bool {
+	level, rest, more := nextLevel(topic)
+	c := node.children[level]
+	if c == nil {
+		return false
+	}
+
+	var deleted bool
+	if more {
+		deleted = s.deleteFrom(c, rest)
+	} else if c.message != nil {
+		c.message = nil
+		deleted = true
+	}
+
+	if deleted && c.message == nil && len(c.children) == 0 {
+		delete(node.children, level)
+	}
+	return deleted
+}
+
+// removeExpired 删除已过期的保留消息并清理空节点，返回删除的数量
+func (s *retainedStore) removeExpired(now time.Time) int {
+	removed := s.removeExpiredFrom(s.root, now)
+	s.count -= removed
+	return removed
+}
+
+func (s *retainedStore) removeExpiredFrom(node *retainedNode, now time.Time) int {
+	removed := 0
+	for level, c := range node.children {
+		removed += s.removeExpiredFrom(c, now)
+		if c.message != nil && c.message.Expired(now) {
+			c.message = nil
+			removed++
+		}
+		if c.message == nil && len(c.children) == 0 {
+			delete(node.children, level)
+		}
+	}
+	return removed
+}
+
+// get 获取主题的保留消息
+func (s *retainedStore) get(topic string) *types.Message {
+	node := s.root
+	rest, more := topic, true
+	for more {
+		var level string
+		level, rest, more = nextLevel(rest)
+		node = node.children[level]
+		if node == nil {
+			return nil
+		}
+	}
+	if node.message != nil && node.message.Expired(time.Now()) {
+		return nil
+	}
+	return node.message
+}
+
+// match 查找与主题过滤器匹配的所有未过期保留消息
+func (s *retainedStore) match(filter string, fn func(message *types.Message)) {
+	now := time.Now()
+	s.matchNode(s.root, filter, true, func(message *types.Message) {
+		// 已过期但尚未被清理的消息不再发送
+		if !message.Expired(now) {
+			fn(message)
+		}
+	})
+}
+
+func (s *retainedStore) matchNode(node *retainedNode, filter string, root bool, fn func(message *types.Message)) {
+	level, rest, more := nextLevel(filter)
+
+	switch level {
+	case "#":
+		// "#" 匹配父级及其后所有层级
+		if !root && node.message != nil {
+			fn(node.message)
+		}
+		for name, c := range node.children {
+			// 以$开头的主题不能被首层通配符匹配
+			if root && strings.HasPrefix(name, "$") {
+				continue
+			}
+			s.visitAll(c, fn)
+		}
+	case "+":
+		for name, c := range node.children {
+			if root && strings.HasPrefix(name, "$") {
+				continue
+			}
+			s.matchLevel(c, rest, more, fn)
+		}
+	default:
+		if c := node.children[level]; c != nil {
+			s.matchLevel(c, rest, more, fn)
+		}
+	}
+}
+
+// matchLevel 在已匹配一个层级的节点上继续匹配剩余过滤器
+func (s *retainedStore) matchLevel(node *retainedNode, rest string, more bool, fn func(message *types.Message)) {
+	if more {
+		s.matchNode(node, rest, false, fn)
+		return
+	}
+	if node.message != nil {
+		fn(node.message)
+	}
+}
+
+func (s *retainedStore) visitAll(node *retainedNode, fn func(message *types.Message)) {
+	if node.message != nil {
+		fn(node.message)
+	}
+	for _, c := range node.children {
+		s.visitAll(c, fn)
+	}
+}
@@ -1,17 +1,50 @@
 package broker
 
 import (
+	"errors"
 	"log/slog"
-	"strings"
 	"sync"
+	"time"
 
 	"busy-cloud/gnet-mqtt/types"
 )
 
+// ErrInvalidTopicFilter 主题过滤器格式错误
+var ErrInvalidTopicFilter = errors.New("invalid topic filter")
+
+// ErrSharedNoLocal 共享订阅不能设置No Local
+var ErrSharedNoLocal = errors.New("no local on shared subscription")
+
+// SubscriptionOptions 订阅选项
+type SubscriptionOptions struct {
+	QoS               byte
+	NoLocal           bool   // 不接收自己发布的消息
+	RetainAsPublished bool   // 转发时保留原消息的保留标志
+	RetainHandling    byte   // 0:订阅时发送保留消息 1:仅新订阅时发送 2:不发送
+	SubscriptionID    uint32 // 订阅标识符，0表示未设置
+}
+
+// Delivery 路由匹配结果，描述向一个订阅者的一次投递
+type Delivery struct {
+	ClientID        string
+	QoS             byte     // 订阅QoS与消息QoS中较小的一个
+	Retain          bool     // Retain As Published时保留原消息的保留标志
+	ShareName       string   // 共享订阅过滤器，非共享订阅为空
+	SubscriptionIDs []uint32 // 所有匹配订阅的订阅标识符
+}
+
+// DeliverFunc 消息投递回调，由管理器实现
+type DeliverFunc func(message *types.Message, delivery *Delivery)
+
 // Router 主题路由器
 type Router struct {
-	subscriptions    map[string]map[string]byte // topic -> clientID -> QoS
-	retainedMessages map[string]*types.Message  // topic -> message
+	subscriptions    *topicTree                     // 订阅树
+	clientFilters    map[string]map[string]struct{} // clientID -> topic filters
+	retainedMessages *retainedStore                 // topic -> message
+	deliver          DeliverFunc
+	sharedStrategy   SharedStrategy
+	retainedTTL      time.Duration
+	status           subscriberStatus
 	mu               sync.RWMutex
 	logger           *slog.Logger
 }
@@ -22,45 +55,97 @@ func NewRouter(logger *slog.Logger) *Router {
 		logger = slog.Default()
 	}
 	return &Router{
-		subscriptions:    make(map[string]map[string]byte),
-		retainedMessages: make(map[string]*types.Message),
+		subscriptions:    newTopicTree(),
+		clientFilters:    make(map[string]map[string]struct{}),
+		retainedMessages: newRetainedStore(),
+		sharedStrategy:   SharedRoundRobin,
 		logger:           logger,
 	}
 }
 
-// Subscribe 添加订阅
-func (r *Router) Subscribe(clientID string, topicFilter []byte, qos byte) {
+// SetDeliverFunc 设置消息投递回调
+func (r *Router) SetDeliverFunc(deliver DeliverFunc) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.deliver = deliver
+}
+
+// SetSharedStrategy 设置共享订阅的成员选择策略
+func (r *Router) SetSharedStrategy(strategy SharedStrategy) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.sharedStrategy = strategy
+}
+
+// SetRetainedTTL 设置未携带MQTT 5.0属性的保留消息（3.1/3.1.1客户端发布）的默认保留时间，0表示永久保留
+func (r *Router) SetRetainedTTL(ttl time.Duration) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
+	r.retainedTTL = ttl
+}
+
+// setSubscriberStatus 设置共享订阅选择成员时使用的订阅者状态
+func (r *Router) setSubscriberStatus(status subscriberStatus) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.status = status
+}
 
+// Subscribe 添加或更新订阅，支持 $share/<group>/<filter> 共享订阅，返回是否为新订阅
+func (r *Router) Subscribe(clientID string, topicFilter []byte, options SubscriptionOptions) (bool, error) {
 	topicKey := string(topicFilter) // 字节数组转字符串用于内部存储
-	if r.subscriptions[topicKey] == nil {
-		r.subscriptions[topicKey] = make(map[string]byte)
+
+	group, filter, shared := parseSharedFilter(topicKey)
+	valid := validTopicFilter(topicKey)
+	if shared {
+		valid = validSharedGroup(group) && validTopicFilter(filter)
+	}
+	if !valid {
+		return false, ErrInvalidTopicFilter
+	}
+	if shared && options.NoLocal {
+		return false, ErrSharedNoLocal
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var added bool
+	if shared {
+		added = r.subscriptions.addShared(topicKey, group, filter, clientID, options)
+	} else {
+		added = r.subscriptions.add(topicKey, clientID, options)
 	}
-	r.subscriptions[topicKey][clientID] = qos
+	if r.clientFilters[clientID] == nil {
+		r.clientFilters[clientID] = make(map[string]struct{})
+	}
+	r.clientFilters[clientID][topicKey] = struct{}{}
 
 	r.logger.Debug("Subscription added",
 		"client_id", clientID,
 		"topic_filter", string(topicFilter), // 日志显示时转换
-		"qos", qos)
+		"qos", options.QoS)
+	return added, nil
 }
 
-// Unsubscribe 取消订阅
-func (r *Router) Unsubscribe(clientID string, topicFilter []byte) {
+// Unsubscribe 取消订阅，返回订阅是否存在
+func (r *Router) Unsubscribe(clientID string, topicFilter []byte) bool {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
 	topicKey := string(topicFilter) // 字节数组转字符串
-	if clients, exists := r.subscriptions[topicKey]; exists {
-		delete(clients, clientID)
-		if len(clients) == 0 {
-			delete(r.subscriptions, topicKey)
+	existed := r.removeSubscription(topicKey, clientID)
+	if filters, exists := r.clientFilters[clientID]; exists {
+		delete(filters, topicKey)
+		if len(filters) == 0 {
+			delete(r.clientFilters, clientID)
 		}
 	}
 
 	r.logger.Debug("Subscription removed",
 		"client_id", clientID,
 		"topic_filter", string(topicFilter)) // 日志显示时转换
+	return existed
 }
 
 // UnsubscribeAll 取消客户端的所有订阅
@@ -68,90 +153,199 @@ func (r *Router) UnsubscribeAll(clientID string) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
-	for topicFilter, clients := range r.subscriptions {
-		delete(clients, clientID)
-		if len(clients) == 0 {
-			delete(r.subscriptions, topicFilter)
-		}
+	for topicFilter := range r.clientFilters[clientID] {
+		r.removeSubscription(topicFilter, clientID)
 	}
+	delete(r.clientFilters, clientID)
 
 	r.logger.Debug("All subscriptions removed", "client_id", clientID)
 }
 
-// RouteMessage 路由消息
-func (r *Router) RouteMessage(message *types.Message) {
-	r.mu.RLock()
-	defer r.mu.RUnlock()
+// removeSubscription 从订阅树删除订阅，调用方需持有写锁
+func (r *Router) removeSubscription(topicKey string, clientID string) bool {
+	if group, filter, shared := parseSharedFilter(topicKey); shared {
+		return r.subscriptions.removeShared(group, filter, clientID)
+	}
+	return r.subscriptions.remove(topicKey, clientID)
+}
 
+// RouteMessage 路由消息，返回投递的订阅者数量
+func (r *Router) RouteMessage(message *types.Message) int {
 	topic := string(message.Topic) // 字节数组转字符串用于匹配
 
 	// 处理保留消息
 	if message.Retain {
+		r.mu.Lock()
 		if len(message.Payload) == 0 {
 			// 空载荷表示删除保留消息
-			delete(r.retainedMessages, topic)
+			r.retainedMessages.delete(topic)
 			r.logger.Debug("Retained message deleted", "topic", topic)
 		} else {
 			// 设置保留消息
-			r.retainedMessages[topic] = message
+			r.retainedMessages.set(topic, r.retainedCopy(message))
 			r.logger.Debug("Retained message set",
 				"topic", topic,
 				"payload_size", len(message.Payload))
 		}
+		r.mu.Unlock()
 	}
 
 	// 查找匹配的订阅者
-	matchedClients := make(map[string]byte)
-
-	for topicFilter, clients := range r.subscriptions {
-		if r.matchTopic(topic, topicFilter) {
-			for clientID, qos := range clients {
-				// 使用订阅的QoS和消息QoS中较小的一个
-				grantedQoS := message.QoS
-				if qos < grantedQoS {
-					grantedQoS = qos
+	var deliveries []*Delivery
+	matchedClients := make(map[string]*Delivery)
+	publisherID := string(message.PublisherID)
+
+	r.mu.RLock()
+	r.subscriptions.match(topic, func(node *topicNode) {
+		for clientID, options := range node.subscribers {
+			// No Local订阅不接收自己发布的消息
+			if options.NoLocal && clientID == publisherID {
+				continue
+			}
+			grantedQoS := minQoS(options.QoS, message.QoS)
+			retain := message.Retain && options.RetainAsPublished
+			// 同一客户端匹配多个过滤器时取最大QoS
+			if d, ok := matchedClients[clientID]; ok {
+				if grantedQoS > d.QoS {
+					d.QoS = grantedQoS
 				}
-				matchedClients[clientID] = grantedQoS
+				d.Retain = d.Retain || retain
+				d.addSubscriptionID(options.SubscriptionID)
+				continue
 			}
+			d := &Delivery{ClientID: clientID, QoS: grantedQoS, Retain: retain}
+			d.addSubscriptionID(options.SubscriptionID)
+			matchedClients[clientID] = d
+			deliveries = append(deliveries, d)
 		}
-	}
+
+		// 每个共享订阅组只选择一个成员
+		for _, group := range node.shared {
+			if d := r.selectShared(group, message, ""); d != nil {
+				deliveries = append(deliveries, d)
+			}
+		}
+	})
+	deliver := r.deliver
+	r.mu.RUnlock()
 
 	r.logger.Debug("Message routed",
 		"topic", topic,
-		"matched_clients", len(matchedClients),
+		"deliveries", len(deliveries),
 		"retain", message.Retain)
 
-	// 这里应该调用管理器的方法来实际发送消息给客户端
-	// 目前只是记录日志
-	for clientID := range matchedClients {
-		r.logger.Debug("Message should be delivered to client",
-			"topic", topic,
-			"client_id", clientID)
+	// 在锁外投递，避免发送时阻塞订阅变更
+	if deliver == nil {
+		return 0
+	}
+	for _, d := range deliveries {
+		deliver(message, d)
 	}
+	return len(deliveries)
 }
 
-// matchTopic 匹配主题和主题过滤器
-func (r *Router) matchTopic(topic string, filter string) bool {
-	topicParts := strings.Split(topic, "/")
-	filterParts := strings.Split(filter, "/")
+// retainedCopy 返回用于保留的消息，必要时复制消息并设置默认保留时间，调用方需持有写锁
+func (r *Router) retainedCopy(message *types.Message) *types.Message {
+	if r.retainedTTL <= 0 || message.Properties != nil || !message.ExpiresAt.IsZero() {
+		return message
+	}
+	retained := *message
+	retained.ExpiresAt = time.Now().Add(r.retainedTTL)
+	return &retained
+}
 
-	for i := 0; i < len(filterParts) && i < len(topicParts); i++ {
-		if filterParts[i] == "#" {
-			return true
-		}
-		if filterParts[i] != "+" && filterParts[i] != topicParts[i] {
-			return false
-		}
+// RouteShared 将消息投递给共享订阅组中除exclude以外的另一个成员，用于成员断开时的故障转移
+func (r *Router) RouteShared(shareName string, message *types.Message, exclude string) bool {
+	group, filter, shared := parseSharedFilter(shareName)
+	if !shared {
+		return false
+	}
+
+	r.mu.RLock()
+	var d *Delivery
+	if g := r.subscriptions.findShared(group, filter); g != nil {
+		d = r.selectShared(g, message, exclude)
+	}
+	deliver := r.deliver
+	r.mu.RUnlock()
+
+	if d == nil || deliver == nil {
+		return false
+	}
+	deliver(message, d)
+	return true
+}
+
+// selectShared 按策略选择共享订阅组成员，调用方需持有读锁
+func (r *Router) selectShared(group *sharedGroup, message *types.Message, exclude string) *Delivery {
+	clientID, ok := group.selectMember(r.sharedStrategy, message, r.status, exclude)
+	if !ok {
+		return nil
+	}
+	options := group.members[clientID]
+	d := &Delivery{
+		ClientID:  clientID,
+		QoS:       minQoS(options.QoS, message.QoS),
+		Retain:    message.Retain && options.RetainAsPublished,
+		ShareName: group.name,
 	}
+	d.addSubscriptionID(options.SubscriptionID)
+	return d
+}
 
-	return len(topicParts) == len(filterParts)
+// addSubscriptionID 记录匹配订阅的订阅标识符
+func (d *Delivery) addSubscriptionID(id uint32) {
+	if id != 0 {
+		d.SubscriptionIDs = append(d.SubscriptionIDs, id)
+	}
+}
+
+// minQoS 返回两个QoS中较小的一个
+func minQoS(a, b byte) byte {
+	if a < b {
+		return a
+	}
+	return b
 }
 
 // GetRetainedMessage 获取保留消息
 func (r *Router) GetRetainedMessage(topic []byte) *types.Message {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
-	return r.retainedMessages[string(topic)] // 字节数组转字符串
+	return r.retainedMessages.get(string(topic)) // 字节数组转字符串
+}
+
+// MatchRetainedMessages 获取与主题过滤器匹配的所有保留消息
+func (r *Router) MatchRetainedMessages(topicFilter []byte) []*types.Message {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var messages []*types.Message
+	r.retainedMessages.match(string(topicFilter), func(message *types.Message) {
+		messages = append(messages, message)
+	})
+	return messages
+}
+
+// RemoveExpiredRetained 删除已过期的保留消息，返回删除的数量
+func (r *Router) RemoveExpiredRetained() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.retainedMessages.removeExpired(time.Now())
+}
+
+// SubscriptionCount 获取订阅关系总数
+func (r *Router) SubscriptionCount() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.subscriptions.count
+}
+
+// RetainedCount 获取保留消息总数
+func (r *Router) RetainedCount() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.retainedMessages.count
 }
 
 // GetSubscriptions 获取所有订阅（用于调试）
@@ -160,12 +354,17 @@ func (r *Router) GetSubscriptions() map[string][]string {
 	defer r.mu.RUnlock()
 
 	result := make(map[string][]string)
-	for topic, clients := range r.subscriptions {
-		clientList := make([]string, 0, len(clients))
-		for clientID := range clients {
-			clientList = append(clientList, clientID)
+	r.subscriptions.walk(func(filter string, node *topicNode) {
+		if len(node.subscribers) > 0 {
+			clientList := make([]string, 0, len(node.subscribers))
+			for clientID := range node.subscribers {
+				clientList = append(clientList, clientID)
+			}
+			result[filter] = clientList
 		}
-		result[topic] = clientList
-	}
+		for _, group := range node.shared {
+			result[group.name] = append([]string(nil), group.order...)
+		}
+	})
 	return result
 }
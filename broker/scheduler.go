@@ -0,0 +1,161 @@
+package broker
+
+import (
+	"container/heap"
+	"context"
+	"sync"
+	"time"
+)
+
+// scheduledTask 定时任务
+type scheduledTask struct {
+	key   string
+	at    time.Time
+	fn    func()
+	index int // 在堆中的位置
+}
+
+// taskHeap 按执行时间排序的最小堆
+type taskHeap []*scheduledTask
+
+func (h taskHeap) Len() int           { return len(h) }
+func (h taskHeap) Less(i, j int) bool { return h[i].at.Before(h[j].at) }
+
+func (h taskHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *taskHeap) Push(x interface{}) {
+	task := x.(*scheduledTask)
+	task.index = len(*h)
+	*h = append(*h, task)
+}
+
+func (h *taskHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	task := old[n-1]
+	old[n-1] = nil
+	*h = old[:n-1]
+	return task
+}
+
+// scheduler 定时任务调度器，所有任务共用一个最小堆、一个定时器和一个goroutine
+// 任务按key唯一，重复调度同一个key会替换原任务
+type scheduler struct {
+	mu     sync.Mutex
+	tasks  taskHeap
+	keys   map[string]*scheduledTask
+	wakeup chan struct{}
+}
+
+func newScheduler() *scheduler {
+	return &scheduler{
+		keys:   make(map[string]*scheduledTask),
+		wakeup: make(chan struct{}, 1),
+	}
+}
+
+// schedule 在at时刻执行fn，替换同一key的已有任务
+func (s *scheduler) schedule(key string, at time.Time, fn func()) {
+	s.mu.Lock()
+	if task, ok := s.keys[key]; ok {
+		task.at = at
+		task.fn = fn
+		heap.Fix(&s.tasks, task.index)
+	} else {
+		task = &scheduledTask{key: key, at: at, fn: fn}
+		heap.Push(&s.tasks, task)
+		s.keys[key] = task
+	}
+	s.mu.Unlock()
+
+	s.notify()
+}
+
+// runNow 将已有任务提前到立即执行，任务不存在时返回false
+func (s *scheduler) runNow(key string) bool {
+	s.mu.Lock()
+	task, ok := s.keys[key]
+	if ok {
+		task.at = time.Now()
+		heap.Fix(&s.tasks, task.index)
+	}
+	s.mu.Unlock()
+
+	if ok {
+		s.notify()
+	}
+	return ok
+}
+
+// cancel 取消任务，任务不存在时返回false
+func (s *scheduler) cancel(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	task, ok := s.keys[key]
+	if !ok {
+		return false
+	}
+	heap.Remove(&s.tasks, task.index)
+	delete(s.keys, key)
+	return true
+}
+
+// notify 唤醒调度循环重新计算等待时间
+func (s *scheduler) notify() {
+	select {
+	case s.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+// run 调度循环，在ctx结束前按时执行到期的任务
+func (s *scheduler) run(ctx context.Context) {
+	timer := time.NewTimer(time.Hour)
+	defer timer.Stop()
+
+	for {
+		wait := s.runDue(time.Now())
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		case <-s.wakeup:
+		}
+	}
+}
+
+// runDue 执行所有到期的任务，返回距下一个任务的等待时间
+func (s *scheduler) runDue(now time.Time) time.Duration {
+	for {
+		s.mu.Lock()
+		if len(s.tasks) == 0 {
+			s.mu.Unlock()
+			return time.Hour
+		}
+		task := s.tasks[0]
+		if task.at.After(now) {
+			s.mu.Unlock()
+			return task.at.Sub(now)
+		}
+		heap.Pop(&s.tasks)
+		delete(s.keys, task.key)
+		s.mu.Unlock()
+
+		// 在锁外执行任务，任务中可以重新调度
+		task.fn()
+	}
+}
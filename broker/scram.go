@@ -0,0 +1,278 @@
+package broker
+
+import (
+	"crypto/hmac"
+	"crypto/pbkdf2"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ScramSHA256Method SCRAM-SHA-256认证方法名
+const ScramSHA256Method = "SCRAM-SHA-256"
+
+// scramIterations 添加用户时使用的PBKDF2迭代次数
+const scramIterations = 4096
+
+// ScramCredential SCRAM-SHA-256凭据，只保存派生密钥，不保存密码
+type ScramCredential struct {
+	Salt       []byte
+	Iterations int
+	StoredKey  []byte
+	ServerKey  []byte
+}
+
+// NewScramCredential 由密码派生SCRAM-SHA-256凭据
+func NewScramCredential(password string, salt []byte, iterations int) (ScramCredential, error) {
+	salted, err := pbkdf2.Key(sha256.New, password, salt, iterations, sha256.Size)
+	if err != nil {
+		return ScramCredential{}, err
+	}
+	storedKey := sha256.Sum256(hmacSHA256(salted, "Client Key"))
+	return ScramCredential{
+		Salt:       salt,
+		Iterations: iterations,
+		StoredKey:  storedKey[:],
+		ServerKey:  hmacSHA256(salted, "Server Key"),
+	}, nil
+}
+
+// CredentialStore SCRAM凭据存储
+type CredentialStore interface {
+	Lookup(username string) (ScramCredential, bool)
+}
+
+// MemoryCredentialStore 内存中的SCRAM凭据存储
+type MemoryCredentialStore struct {
+	mu          sync.RWMutex
+	credentials map[string]ScramCredential
+}
+
+// NewMemoryCredentialStore 创建内存凭据存储
+func NewMemoryCredentialStore() *MemoryCredentialStore {
+	return &MemoryCredentialStore{
+		credentials: make(map[string]ScramCredential),
+	}
+}
+
+// AddUser 使用随机盐添加或替换用户
+func (s *MemoryCredentialStore) AddUser(username string, password string) error {
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	credential, err := NewScramCredential(password, salt, scramIterations)
+	if err != nil {
+		return err
+	}
+	s.SetCredential(username, credential)
+	return nil
+}
+
+// SetCredential 设置用户的凭据
+func (s *MemoryCredentialStore) SetCredential(username string, credential ScramCredential) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.credentials[username] = credential
+}
+
+// RemoveUser 删除用户
+func (s *MemoryCredentialStore) RemoveUser(username string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.credentials, username)
+}
+
+// Lookup 查找用户的凭据
+func (s *MemoryCredentialStore) Lookup(username string) (ScramCredential, bool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	credential, ok := s.credentials[username]
+	return credential, ok
+}
+
+// ScramAuthenticator SCRAM-SHA-256增强认证（RFC 5802/7677），不支持通道绑定
+type ScramAuthenticator struct {
+	store  CredentialStore
+	secret []byte // 为不存在的用户生成固定的假盐
+}
+
+// NewScramAuthenticator 创建使用指定凭据存储的SCRAM-SHA-256认证方法
+func NewScramAuthenticator(store CredentialStore) *ScramAuthenticator {
+	secret := make([]byte, sha256.Size)
+	rand.Read(secret)
+	return &ScramAuthenticator{store: store, secret: secret}
+}
+
+// Method 认证方法名
+func (a *ScramAuthenticator) Method() string {
+	return ScramSHA256Method
+}
+
+// Start 开始新的SCRAM交换
+func (a *ScramAuthenticator) Start(clientID []byte) AuthExchange {
+	return &scramExchange{store: a.store, secret: a.secret}
+}
+
+// scramExchange 一次SCRAM交换：client-first -> server-first -> client-final -> server-final
+type scramExchange struct {
+	store           CredentialStore
+	secret          []byte
+	step            int
+	gs2Header       string
+	clientFirstBare string
+	serverFirst     string
+	nonce           string
+	username        string
+	credential      ScramCredential
+	unknown         bool // 用户不存在，在校验客户端证明时失败
+	verified        bool
+}
+
+// Next 处理客户端消息
+func (e *scramExchange) Next(data []byte) ([]byte, bool, error) {
+	e.step++
+	switch e.step {
+	case 1:
+		serverFirst, err := e.clientFirst(string(data))
+		return serverFirst, false, err
+	case 2:
+		serverFinal, err := e.clientFinal(string(data))
+		e.verified = err == nil
+		return serverFinal, e.verified, err
+	}
+	return nil, false, ErrAuthFailed
+}
+
+// Principal 客户端证明通过后返回client-first-message中的用户名
+func (e *scramExchange) Principal() string {
+	if !e.verified {
+		return ""
+	}
+	return e.username
+}
+
+// clientFirst 处理client-first-message，返回server-first-message
+func (e *scramExchange) clientFirst(message string) ([]byte, error) {
+	// gs2-header: "n,," 或 "y,,"，"p=" 表示要求通道绑定
+	parts := strings.SplitN(message, ",", 3)
+	if len(parts) != 3 || (parts[0] != "n" && parts[0] != "y") {
+		return nil, ErrAuthFailed
+	}
+	e.gs2Header = parts[0] + "," + parts[1] + ","
+	e.clientFirstBare = parts[2]
+
+	attrs, ok := scramAttributes(e.clientFirstBare)
+	if !ok || attrs["n"] == "" || attrs["r"] == "" || attrs["m"] != "" {
+		return nil, ErrAuthFailed
+	}
+	username, ok := scramUnescape(attrs["n"])
+	if !ok {
+		return nil, ErrAuthFailed
+	}
+
+	// 不存在的用户同样返回挑战，使用由用户名派生的固定假盐，避免通过失败的步骤枚举用户名 (RFC 5802 §5.1)
+	credential, ok := e.store.Lookup(username)
+	if !ok {
+		credential = ScramCredential{
+			Salt:       hmacSHA256(e.secret, username)[:16],
+			Iterations: scramIterations,
+		}
+		e.unknown = true
+	}
+	e.username = username
+	e.credential = credential
+
+	serverNonce := make([]byte, 18)
+	if _, err := rand.Read(serverNonce); err != nil {
+		return nil, err
+	}
+	e.nonce = attrs["r"] + base64.StdEncoding.EncodeToString(serverNonce)
+	e.serverFirst = "r=" + e.nonce +
+		",s=" + base64.StdEncoding.EncodeToString(credential.Salt) +
+		",i=" + strconv.Itoa(credential.Iterations)
+
+	return []byte(e.serverFirst), nil
+}
+
+// clientFinal 校验client-final-message中的客户端证明，返回server-final-message
+func (e *scramExchange) clientFinal(message string) ([]byte, error) {
+	i := strings.LastIndex(message, ",p=")
+	if i < 0 {
+		return nil, ErrAuthFailed
+	}
+	withoutProof := message[:i]
+	proof, err := base64.StdEncoding.DecodeString(message[i+3:])
+	if err != nil || len(proof) != sha256.Size {
+		return nil, ErrAuthFailed
+	}
+
+	attrs, ok := scramAttributes(withoutProof)
+	if !ok || attrs["c"] != base64.StdEncoding.EncodeToString([]byte(e.gs2Header)) || attrs["r"] != e.nonce {
+		return nil, ErrAuthFailed
+	}
+
+	// ClientKey = ClientProof XOR HMAC(StoredKey, AuthMessage)，校验 H(ClientKey) == StoredKey
+	authMessage := e.clientFirstBare + "," + e.serverFirst + "," + withoutProof
+	clientSignature := hmacSHA256(e.credential.StoredKey, authMessage)
+	clientKey := make([]byte, sha256.Size)
+	for j := range clientKey {
+		clientKey[j] = proof[j] ^ clientSignature[j]
+	}
+	storedKey := sha256.Sum256(clientKey)
+	if subtle.ConstantTimeCompare(storedKey[:], e.credential.StoredKey) != 1 || e.unknown {
+		return nil, ErrAuthFailed
+	}
+
+	serverSignature := hmacSHA256(e.credential.ServerKey, authMessage)
+	return []byte("v=" + base64.StdEncoding.EncodeToString(serverSignature)), nil
+}
+
+// scramAttributes 解析以逗号分隔的 key=value 属性
+func scramAttributes(message string) (map[string]string, bool) {
+	attrs := make(map[string]string)
+	for _, attr := range strings.Split(message, ",") {
+		if len(attr) < 2 || attr[1] != '=' {
+			return nil, false
+		}
+		attrs[attr[:1]] = attr[2:]
+	}
+	return attrs, true
+}
+
+// scramUnescape 还原用户名中转义的 "=2C" 和 "=3D"
+func scramUnescape(name string) (string, bool) {
+	if !strings.Contains(name, "=") {
+		return name, true
+	}
+	var b strings.Builder
+	for i := 0; i < len(name); i++ {
+		if name[i] != '=' {
+			b.WriteByte(name[i])
+			continue
+		}
+		if i+2 >= len(name) {
+			return "", false
+		}
+		switch name[i+1 : i+3] {
+		case "2C":
+			b.WriteByte(',')
+		case "3D":
+			b.WriteByte('=')
+		default:
+			return "", false
+		}
+		i += 2
+	}
+	return b.String(), true
+}
+
+func hmacSHA256(key []byte, message string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(message))
+	return mac.Sum(nil)
+}
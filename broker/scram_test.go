@@ -0,0 +1,225 @@
+package broker
+
+import (
+	"bytes"
+	"crypto/pbkdf2"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+
+	"busy-cloud/gnet-mqtt/mqtt"
+)
+
+// scramClient 按RFC 5802计算客户端消息
+type scramClient struct {
+	username    string // 已转义的用户名
+	password    string
+	nonce       string
+	salted      []byte
+	authMessage string
+}
+
+func (c *scramClient) first() []byte {
+	return []byte("n,,n=" + c.username + ",r=" + c.nonce)
+}
+
+// final 由server-first-message计算client-final-message，nonce为空时使用服务端返回的nonce
+func (c *scramClient) final(t *testing.T, serverFirst []byte, nonce string) []byte {
+	t.Helper()
+	attrs, ok := scramAttributes(string(serverFirst))
+	if !ok || !strings.HasPrefix(attrs["r"], c.nonce) {
+		t.Fatalf("bad server-first-message %q", serverFirst)
+	}
+	salt, err := base64.StdEncoding.DecodeString(attrs["s"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	iterations, err := strconv.Atoi(attrs["i"])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if nonce == "" {
+		nonce = attrs["r"]
+	}
+
+	c.salted, err = pbkdf2.Key(sha256.New, c.password, salt, iterations, sha256.Size)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientKey := hmacSHA256(c.salted, "Client Key")
+	storedKey := sha256.Sum256(clientKey)
+	withoutProof := "c=biws,r=" + nonce
+	c.authMessage = "n=" + c.username + ",r=" + c.nonce + "," + string(serverFirst) + "," + withoutProof
+	proof := hmacSHA256(storedKey[:], c.authMessage)
+	for i := range proof {
+		proof[i] ^= clientKey[i]
+	}
+	return []byte(withoutProof + ",p=" + base64.StdEncoding.EncodeToString(proof))
+}
+
+// serverFinal 期望的server-final-message
+func (c *scramClient) serverFinal() []byte {
+	serverKey := hmacSHA256(c.salted, "Server Key")
+	return []byte("v=" + base64.StdEncoding.EncodeToString(hmacSHA256(serverKey, c.authMessage)))
+}
+
+func newTestScramAuthenticator(t *testing.T) *ScramAuthenticator {
+	t.Helper()
+	store := NewMemoryCredentialStore()
+	if err := store.AddUser("user", "pencil"); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.AddUser("a,b=c", "secret"); err != nil {
+		t.Fatal(err)
+	}
+	return NewScramAuthenticator(store)
+}
+
+func TestScramExchange(t *testing.T) {
+	authenticator := newTestScramAuthenticator(t)
+
+	tests := []struct {
+		name      string
+		username  string
+		password  string
+		nonce     string // 非空时替换client-final-message中的nonce
+		principal string
+	}{
+		{name: "success", username: "user", password: "pencil", principal: "user"},
+		{name: "escaped username", username: "a=2Cb=3Dc", password: "secret", principal: "a,b=c"},
+		{name: "wrong proof", username: "user", password: "wrong"},
+		{name: "nonce mismatch", username: "user", password: "pencil", nonce: "rOprNGfwEbeRWgbNEkqO"},
+		{name: "unknown user", username: "nobody", password: "pencil"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := &scramClient{username: tt.username, password: tt.password, nonce: "rOprNGfwEbeRWgbNEkqO"}
+			exchange := authenticator.Start([]byte("client"))
+
+			// 不存在的用户同样收到挑战
+			serverFirst, done, err := exchange.Next(client.first())
+			if err != nil || done {
+				t.Fatalf("client-first: done=%v, %v", done, err)
+			}
+
+			serverFinal, done, err := exchange.Next(client.final(t, serverFirst, tt.nonce))
+			if tt.principal == "" {
+				if !errors.Is(err, ErrAuthFailed) || done {
+					t.Fatalf("client-final: done=%v, %v", done, err)
+				}
+				if exchange.Principal() != "" {
+					t.Fatalf("principal %q after failed exchange", exchange.Principal())
+				}
+				return
+			}
+			if err != nil || !done {
+				t.Fatalf("client-final: done=%v, %v", done, err)
+			}
+			if !bytes.Equal(serverFinal, client.serverFinal()) {
+				t.Fatalf("server-final-message %q, want %q", serverFinal, client.serverFinal())
+			}
+			if exchange.Principal() != tt.principal {
+				t.Fatalf("principal %q, want %q", exchange.Principal(), tt.principal)
+			}
+		})
+	}
+}
+
+func TestScramUnknownUserChallengeIsStable(t *testing.T) {
+	authenticator := newTestScramAuthenticator(t)
+
+	challenge := func(username string) map[string]string {
+		client := &scramClient{username: username, nonce: "abc"}
+		serverFirst, _, err := authenticator.Start(nil).Next(client.first())
+		if err != nil {
+			t.Fatalf("%s: %v", username, err)
+		}
+		attrs, _ := scramAttributes(string(serverFirst))
+		return attrs
+	}
+
+	// 同一用户名每次得到相同的盐，不同用户名的盐不同
+	first, second := challenge("nobody"), challenge("nobody")
+	if first["s"] != second["s"] || first["i"] != strconv.Itoa(scramIterations) {
+		t.Fatalf("unstable challenge for unknown user: %v, %v", first, second)
+	}
+	if challenge("someone")["s"] == first["s"] {
+		t.Fatal("unknown users share a salt")
+	}
+}
+
+func TestScramRejectsMalformedClientFirst(t *testing.T) {
+	authenticator := newTestScramAuthenticator(t)
+
+	for _, message := range []string{
+		"n,,n=a=2Xb,r=abc", // 无效转义
+		"n,,n=a=2,r=abc",   // 转义不完整
+		"p=tls-unique,,n=user,r=abc",
+		"n,,n=user",
+		"n,,m=ext,n=user,r=abc",
+	} {
+		if _, _, err := authenticator.Start(nil).Next([]byte(message)); !errors.Is(err, ErrAuthFailed) {
+			t.Errorf("%q: %v", message, err)
+		}
+	}
+}
+
+// scramConnect 使用SCRAM-SHA-256完成CONNECT期间的认证交换，返回CONNACK
+func scramConnect(t *testing.T, m *Manager, username string, usernameFlag bool) (*testClient, []byte) {
+	t.Helper()
+	client := &scramClient{username: "user", password: "pencil", nonce: "fyko+d2lbbFgONRv9qkxdawL"}
+	c := newTestClient(t, m, mqtt.Version5)
+	c.send(&mqtt.ConnectPacket{
+		ProtocolName:  []byte("MQTT"),
+		ProtocolLevel: mqtt.Version5,
+		CleanSession:  true,
+		ClientID:      []byte("scram-client"),
+		UsernameFlag:  usernameFlag,
+		Username:      []byte(username),
+		Properties: &mqtt.Properties{
+			AuthenticationMethod: []byte(ScramSHA256Method),
+			AuthenticationData:   client.first(),
+		},
+	})
+
+	auth := c.decode(mqtt.AUTH).(*mqtt.AuthPacket)
+	if auth.ReasonCode != mqtt.ReasonContinueAuthentication {
+		t.Fatalf("AUTH reason code 0x%02x", auth.ReasonCode)
+	}
+	c.send(&mqtt.AuthPacket{
+		ReasonCode: mqtt.ReasonContinueAuthentication,
+		Properties: &mqtt.Properties{
+			AuthenticationMethod: []byte(ScramSHA256Method),
+			AuthenticationData:   client.final(t, auth.Properties.AuthenticationData, ""),
+		},
+	})
+	return c, c.expect(mqtt.CONNACK)
+}
+
+func TestScramConnectUsername(t *testing.T) {
+	m := newTestManager(DefaultConfig())
+	m.RegisterAuthenticator(newTestScramAuthenticator(t))
+
+	// 未提供用户名或用户名与认证身份一致时连接成功
+	for _, usernameFlag := range []bool{false, true} {
+		c, connAck := scramConnect(t, m, "user", usernameFlag)
+		if connAck[3] != mqtt.ReasonSuccess {
+			t.Fatalf("username flag %v: CONNACK 0x%02x", usernameFlag, connAck[3])
+		}
+		clientCtx, _ := m.clients.Load(c.conn)
+		if got := string(clientCtx.(*ClientContext).Client.Username); got != "user" {
+			t.Fatalf("username %q, want principal", got)
+		}
+		c.disconnect()
+	}
+
+	// CONNECT中的用户名与认证身份不一致时拒绝
+	c, connAck := scramConnect(t, m, "admin", true)
+	if connAck[3] != mqtt.ReasonNotAuthorized {
+		t.Fatalf("mismatched username: CONNACK 0x%02x", connAck[3])
+	}
+	c.expectClosed()
+}
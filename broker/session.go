@@ -0,0 +1,528 @@
+package broker
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"busy-cloud/gnet-mqtt/mqtt"
+	"busy-cloud/gnet-mqtt/types"
+)
+
+// outboundMessage 待发送给客户端的消息
+type outboundMessage struct {
+	message         *types.Message
+	qos             byte
+	retain          bool
+	shareName       string   // 来自共享订阅时为共享订阅过滤器
+	subscriptionIDs []uint32 // 匹配订阅的订阅标识符
+}
+
+// inflightMessage 已发送但未确认的消息
+type inflightMessage struct {
+	*outboundMessage
+	packetID uint16
+	seq      uint64 // 发送顺序，重发时按原顺序发送
+	sentAt   time.Time
+	released bool // QoS 2已收到PUBREC，等待PUBCOMP
+	unsent   bool // 重发时发送队列已满，等待补发
+}
+
+// ClientSession 客户端会话
+type ClientSession struct {
+	ClientID     string
+	CleanSession bool
+
+	mu           sync.Mutex
+	clientCtx    *ClientContext // 当前连接，离线时为nil
+	inflight     map[uint16]*inflightMessage
+	received     map[uint16]struct{} // 已收到但未释放的QoS 2报文标识符
+	pending      []*outboundMessage
+	nextPacketID uint16
+	seq          uint64
+	maxInflight  int
+	maxPending   int
+}
+
+// newClientSession 创建新的会话
+func newClientSession(clientID string, cleanSession bool, config *Config) *ClientSession {
+	return &ClientSession{
+		ClientID:     clientID,
+		CleanSession: cleanSession,
+		inflight:     make(map[uint16]*inflightMessage),
+		received:     make(map[uint16]struct{}),
+		maxInflight:  config.MaxInflight,
+		maxPending:   config.MaxQueuedMessages,
+	}
+}
+
+// attach 将会话绑定到新连接，会话是否随连接结束由新连接的会话过期间隔决定
+func (s *ClientSession) attach(clientCtx *ClientContext) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.clientCtx = clientCtx
+	s.CleanSession = clientCtx.Client.SessionExpiryInterval == 0
+	s.maxInflight = clientCtx.receiveMaximum
+	clientCtx.session = s
+}
+
+// resume 按原顺序重发未确认的消息并发送离线期间排队的消息，需在CONNACK之后调用
+func (s *ClientSession) resume() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	clientCtx := s.clientCtx
+	if clientCtx == nil {
+		return
+	}
+
+	now := time.Now()
+	for _, im := range s.inflight {
+		im.sentAt = now
+		im.unsent = true
+	}
+	s.flush()
+}
+
+// setCleanSession 设置会话是否随连接结束，调用方需持有m.mu
+func (s *ClientSession) setCleanSession(clean bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.CleanSession = clean
+}
+
+// receive 记录收到的QoS 2报文标识符，返回是否为首次收到
+// limit大于0且未释放的报文标识符已达limit时不记录，exceeded为true
+func (s *ClientSession) receive(packetID uint16, limit int) (first bool, exceeded bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.received[packetID]; ok {
+		return false, false
+	}
+	if limit > 0 && len(s.received) >= limit {
+		return false, true
+	}
+	s.received[packetID] = struct{}{}
+	return true, false
+}
+
+// release 收到PUBREL后释放QoS 2报文标识符
+func (s *ClientSession) release(packetID uint16) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.received[packetID]; !ok {
+		return false
+	}
+	delete(s.received, packetID)
+	return true
+}
+
+// takeover 解除会话与当前连接的绑定，返回被接管的连接
+func (s *ClientSession) takeover() *ClientContext {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	clientCtx := s.clientCtx
+	s.clientCtx = nil
+	return clientCtx
+}
+
+// detach 解除会话与连接的绑定，连接已被替换时不做处理
+func (s *ClientSession) detach(clientCtx *ClientContext) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.clientCtx != clientCtx {
+		return false
+	}
+	s.clientCtx = nil
+	return true
+}
+
+// publish 向会话投递消息，返回消息是否被发送或排队
+func (s *ClientSession) publish(om *outboundMessage) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.clientCtx == nil {
+		// 离线时只为持久会话保存QoS>0消息
+		if om.qos == 0 || s.CleanSession {
+			return false
+		}
+		return s.enqueue(om)
+	}
+
+	if om.qos == 0 {
+		_, sent := s.sendPublish(om, 0, false)
+		return sent
+	}
+
+	// 发送窗口已满或已有排队消息时进入等待队列，保证消息顺序
+	if len(s.inflight) >= s.maxInflight || len(s.pending) > 0 {
+		return s.enqueue(om)
+	}
+
+	encoded, sent := s.sendInflight(om)
+	if !encoded {
+		return false
+	}
+	// 发送队列已满时留在等待队列中，之后不带DUP标志发送
+	if !sent {
+		return s.enqueue(om)
+	}
+	return true
+}
+
+// enqueue 将消息放入等待队列，队列已满时丢弃
+func (s *ClientSession) enqueue(om *outboundMessage) bool {
+	if len(s.pending) >= s.maxPending {
+		return false
+	}
+	s.pending = append(s.pending, om)
+	return true
+}
+
+// requeue 将共享订阅故障转移失败的消息放回持久会话的等待队列
+func (s *ClientSession) requeue(om *outboundMessage) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.CleanSession {
+		return false
+	}
+	return s.enqueue(om)
+}
+
+// takeShared 取出来自共享订阅、尚未被确认的QoS 1消息及等待队列中的共享订阅消息
+func (s *ClientSession) takeShared() []*outboundMessage {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var taken []*outboundMessage
+	for _, im := range s.sortedInflight() {
+		if im.shareName != "" && im.qos == 1 {
+			delete(s.inflight, im.packetID)
+			taken = append(taken, im.outboundMessage)
+		}
+	}
+
+	pending := s.pending[:0]
+	for _, om := range s.pending {
+		if om.shareName != "" {
+			taken = append(taken, om)
+		} else {
+			pending = append(pending, om)
+		}
+	}
+	clear(s.pending[len(pending):])
+	s.pending = pending
+
+	return taken
+}
+
+// load 未确认及等待发送的消息数量
+func (s *ClientSession) load() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.inflight) + len(s.pending)
+}
+
+// overloaded 会话在线且等待队列已满时返回其连接
+func (s *ClientSession) overloaded() *ClientContext {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.clientCtx == nil || s.maxPending == 0 || len(s.pending) < s.maxPending {
+		return nil
+	}
+	return s.clientCtx
+}
+
+// online 会话是否绑定了连接
+func (s *ClientSession) online() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.clientCtx != nil
+}
+
+// sendInflight 分配报文标识符并发送QoS>0消息，消息进入发送队列后才占用发送窗口
+// 超过客户端最大报文长度时encoded为false，发送队列已满时sent为false
+func (s *ClientSession) sendInflight(om *outboundMessage) (encoded bool, sent bool) {
+	s.seq++
+	im := &inflightMessage{
+		outboundMessage: om,
+		packetID:        s.allocPacketID(),
+		seq:             s.seq,
+		sentAt:          time.Now(),
+	}
+	encoded, sent = s.transmit(im, false)
+	if sent {
+		s.inflight[im.packetID] = im
+	}
+	return encoded, sent
+}
+
+// resend 重发未确认的消息，新连接的最大报文长度容纳不下时丢弃该消息
+// 发送队列已满时标记为待补发并返回false
+func (s *ClientSession) resend(im *inflightMessage) bool {
+	encoded, sent := s.transmit(im, true)
+	if !encoded {
+		delete(s.inflight, im.packetID)
+		return true
+	}
+	im.unsent = !sent
+	return sent
+}
+
+// flush 按原顺序补发待补发的消息，全部发出后再从等待队列补充发送窗口
+func (s *ClientSession) flush() {
+	if s.clientCtx == nil {
+		return
+	}
+	for _, im := range s.sortedInflight() {
+		if im.unsent && !s.resend(im) {
+			return
+		}
+	}
+	s.drainPending()
+}
+
+// deliver 补发因发送队列已满而未能发出的消息
+func (s *ClientSession) deliver() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.flush()
+}
+
+// ack 收到PUBACK，确认QoS 1消息并从等待队列补充发送窗口
+func (s *ClientSession) ack(packetID uint16) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	im, ok := s.inflight[packetID]
+	if !ok || im.qos != 1 {
+		return false
+	}
+	delete(s.inflight, packetID)
+
+	s.flush()
+	return true
+}
+
+// rec 收到PUBREC，标记QoS 2消息已送达并回复PUBREL
+func (s *ClientSession) rec(packetID uint16) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	im, ok := s.inflight[packetID]
+	if !ok || im.qos != 2 {
+		return false
+	}
+	im.released = true
+	im.sentAt = time.Now()
+
+	if s.clientCtx != nil {
+		_, sent := s.transmit(im, false)
+		im.unsent = !sent
+	}
+	return true
+}
+
+// comp 收到PUBCOMP，完成QoS 2消息并从等待队列补充发送窗口
+func (s *ClientSession) comp(packetID uint16) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	im, ok := s.inflight[packetID]
+	if !ok || !im.released {
+		return false
+	}
+	delete(s.inflight, packetID)
+
+	s.flush()
+	return true
+}
+
+// drainPending 在发送窗口允许时发送等待队列中的消息，发送队列已满时停止
+func (s *ClientSession) drainPending() {
+	if s.clientCtx == nil {
+		return
+	}
+
+	now := time.Now()
+	n := 0
+	for n < len(s.pending) && len(s.inflight) < s.maxInflight {
+		om := s.pending[n]
+		// 排队期间过期的消息不再发送
+		if !om.message.Expired(now) {
+			if encoded, sent := s.sendInflight(om); encoded && !sent {
+				break
+			}
+		}
+		s.pending[n] = nil
+		n++
+	}
+	s.pending = s.pending[n:]
+}
+
+// dropExpired 丢弃等待队列中已过期的消息，返回丢弃的数量
+func (s *ClientSession) dropExpired(now time.Time) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	pending := s.pending[:0]
+	for _, om := range s.pending {
+		if !om.message.Expired(now) {
+			pending = append(pending, om)
+		}
+	}
+	dropped := len(s.pending) - len(pending)
+	clear(s.pending[len(pending):])
+	s.pending = pending
+	return dropped
+}
+
+// retry 重发超过重发间隔仍未确认的消息
+// MQTT 5只允许在重连时重发 [MQTT-4.4.0-1]，不做定时重发
+func (s *ClientSession) retry(interval time.Duration) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.clientCtx == nil || s.clientCtx.Client.ProtocolVersion == mqtt.Version5 {
+		return 0
+	}
+
+	now := time.Now()
+	count := 0
+	for _, im := range s.sortedInflight() {
+		if now.Sub(im.sentAt) < interval {
+			continue
+		}
+		im.sentAt = now
+		if !s.resend(im) {
+			break
+		}
+		count++
+	}
+	return count
+}
+
+// allocPacketID 分配未被占用的非零报文标识符
+func (s *ClientSession) allocPacketID() uint16 {
+	for {
+		s.nextPacketID++
+		if s.nextPacketID == 0 {
+			s.nextPacketID = 1
+		}
+		if _, used := s.inflight[s.nextPacketID]; !used {
+			return s.nextPacketID
+		}
+	}
+}
+
+// sortedInflight 按发送顺序返回未确认的消息
+func (s *ClientSession) sortedInflight() []*inflightMessage {
+	list := make([]*inflightMessage, 0, len(s.inflight))
+	for _, im := range s.inflight {
+		list = append(list, im)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].seq < list[j].seq
+	})
+	return list
+}
+
+// transmit 发送未确认消息，已收到PUBREC的QoS 2消息发送PUBREL
+// 超过客户端最大报文长度时encoded为false，发送队列已满时sent为false
+func (s *ClientSession) transmit(im *inflightMessage, dup bool) (encoded bool, sent bool) {
+	if im.released {
+		return true, s.clientCtx.send(mqtt.CreatePubRel(s.clientCtx.Client.ProtocolVersion, im.packetID, mqtt.ReasonSuccess, nil))
+	}
+	return s.sendPublish(im.outboundMessage, im.packetID, dup)
+}
+
+// sendPublish 编码并发送PUBLISH报文，报文进入发送队列后才建立其中新分配的主题别名
+// 超过客户端最大报文长度时encoded为false
+func (s *ClientSession) sendPublish(om *outboundMessage, packetID uint16, dup bool) (encoded bool, sent bool) {
+	data, alias := s.encodePublish(om, packetID, dup)
+	if data == nil {
+		return false, false
+	}
+	sent = s.clientCtx.send(data)
+	if sent && alias != 0 {
+		s.clientCtx.aliases.commit(om.message.Topic, alias)
+	}
+	return true, sent
+}
+
+// encodePublish 按当前连接的协议版本编码PUBLISH报文，超过客户端最大报文长度时返回nil
+// newAlias不为0时报文携带了尚未建立的主题别名
+func (s *ClientSession) encodePublish(om *outboundMessage, packetID uint16, dup bool) (data []byte, newAlias uint16) {
+	version := s.clientCtx.Client.ProtocolVersion
+	topic := om.message.Topic
+	props := forwardProperties(version, om.message)
+	if version == mqtt.Version5 && len(om.subscriptionIDs) > 0 {
+		if props == nil {
+			props = &mqtt.Properties{}
+		}
+		props.SubscriptionIdentifiers = om.subscriptionIDs
+	}
+
+	// 已建立的别名只发送别名，主题名为空
+	alias, known := s.clientCtx.aliases.assign(topic)
+	if alias != 0 {
+		if props == nil {
+			props = &mqtt.Properties{}
+		}
+		props.TopicAlias = mqtt.Uint16(alias)
+		if known {
+			topic = nil
+		} else {
+			newAlias = alias
+		}
+	}
+
+	data = mqtt.CreatePublish(version, &mqtt.PublishPacket{
+		TopicName:  topic,
+		Payload:    om.message.Payload,
+		QoS:        om.qos,
+		PacketID:   packetID,
+		Retain:     om.retain,
+		Dup:        dup,
+		Properties: props,
+	})
+
+	// 客户端不接收超过Maximum Packet Size的报文
+	if limit := s.clientCtx.maxPacketSize; limit > 0 && uint32(len(data)) > limit {
+		return nil, 0
+	}
+	return data, newAlias
+}
+
+// forwardProperties 选取需要转发给订阅者的发布属性，消息过期间隔为剩余时间
+func forwardProperties(version byte, message *types.Message) *mqtt.Properties {
+	if version != mqtt.Version5 {
+		return nil
+	}
+
+	var forwarded *mqtt.Properties
+	if props := message.Properties; props != nil {
+		forwarded = &mqtt.Properties{
+			PayloadFormatIndicator: props.PayloadFormatIndicator,
+			ContentType:            props.ContentType,
+			ResponseTopic:          props.ResponseTopic,
+			CorrelationData:        props.CorrelationData,
+			UserProperties:         props.UserProperties,
+		}
+	}
+	if interval, ok := message.ExpiryInterval(time.Now()); ok {
+		if forwarded == nil {
+			forwarded = &mqtt.Properties{}
+		}
+		forwarded.MessageExpiryInterval = mqtt.Uint32(interval)
+	}
+	return forwarded
+}
@@ -0,0 +1,400 @@
+package broker
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"busy-cloud/gnet-mqtt/mqtt"
+)
+
+// newDeliveryManager 创建不发布$SYS主题的Manager
+func newDeliveryManager(t *testing.T, configure func(*Config)) *Manager {
+	config := DefaultConfig()
+	config.SysInterval = 0
+	if configure != nil {
+		configure(config)
+	}
+	return newTestManager(config)
+}
+
+// startManager 启动调度器，测试结束时停止
+func startManager(t *testing.T, m *Manager) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	m.Start(ctx)
+}
+
+// sessionState 会话未确认及等待发送的消息数量
+func sessionState(m *Manager, clientID string) (inflight int, pending int) {
+	value, ok := m.sessions.Load(clientID)
+	if !ok {
+		return 0, 0
+	}
+	s := value.(*ClientSession)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.inflight), len(s.pending)
+}
+
+// publishQoS2 完成一次QoS 2发布：PUBLISH -> PUBREC -> PUBREL -> PUBCOMP
+func (c *testClient) publishQoS2(packetID uint16, topic, payload string) {
+	c.t.Helper()
+	c.send(&mqtt.PublishPacket{TopicName: []byte(topic), Payload: []byte(payload), QoS: 2, PacketID: packetID})
+	if rec := c.decode(mqtt.PUBREC).(*mqtt.PubRecPacket); rec.PacketID != packetID {
+		c.t.Fatalf("PUBREC for %d, want %d", rec.PacketID, packetID)
+	}
+	c.send(&mqtt.PubRelPacket{PacketID: packetID})
+	if comp := c.decode(mqtt.PUBCOMP).(*mqtt.PubCompPacket); comp.PacketID != packetID {
+		c.t.Fatalf("PUBCOMP for %d, want %d", comp.PacketID, packetID)
+	}
+}
+
+func TestQoS1InflightWindow(t *testing.T) {
+	m := newDeliveryManager(t, nil)
+	sub, _ := connectClient(t, m, mqtt.Version5, "sub", true, &mqtt.Properties{ReceiveMaximum: mqtt.Uint16(2)})
+	sub.subscribe(1, "t", 1)
+	pub, _ := connectClient(t, m, mqtt.Version311, "pub", true, nil)
+
+	for i := 1; i <= 3; i++ {
+		pub.publishQoS1(uint16(i), "t", fmt.Sprint("m", i))
+	}
+
+	// Receive Maximum为2，第三条消息等待确认后发送
+	first := sub.expectPublish("t", "m1", 1, false)
+	second := sub.expectPublish("t", "m2", 1, false)
+	if first.PacketID == 0 || first.PacketID == second.PacketID {
+		t.Fatalf("packet ids %d, %d", first.PacketID, second.PacketID)
+	}
+	sub.expectNone()
+	if inflight, pending := sessionState(m, "sub"); inflight != 2 || pending != 1 {
+		t.Fatalf("inflight=%d pending=%d", inflight, pending)
+	}
+
+	// 未知的报文标识符不释放发送窗口
+	sub.send(&mqtt.PubAckPacket{PacketID: 999})
+	sub.expectNone()
+
+	sub.send(&mqtt.PubAckPacket{PacketID: second.PacketID})
+	third := sub.expectPublish("t", "m3", 1, false)
+	sub.send(&mqtt.PubAckPacket{PacketID: first.PacketID})
+	sub.send(&mqtt.PubAckPacket{PacketID: third.PacketID})
+	sub.expectNone()
+	if inflight, pending := sessionState(m, "sub"); inflight != 0 || pending != 0 {
+		t.Fatalf("inflight=%d pending=%d after acks", inflight, pending)
+	}
+}
+
+func TestQoS2Delivery(t *testing.T) {
+	m := newDeliveryManager(t, nil)
+	sub, _ := connectClient(t, m, mqtt.Version5, "sub", true, &mqtt.Properties{ReceiveMaximum: mqtt.Uint16(1)})
+	sub.subscribe(1, "t", 2)
+	pub, _ := connectClient(t, m, mqtt.Version311, "pub", true, nil)
+
+	pub.publishQoS2(1, "t", "m1")
+	pub.publishQoS2(2, "t", "m2")
+
+	first := sub.expectPublish("t", "m1", 2, false)
+	sub.expectNone()
+
+	// PUBREC之后回复PUBREL，发送窗口直到PUBCOMP才释放
+	sub.send(&mqtt.PubRecPacket{PacketID: first.PacketID})
+	if rel := sub.decode(mqtt.PUBREL).(*mqtt.PubRelPacket); rel.PacketID != first.PacketID {
+		t.Fatalf("PUBREL for %d, want %d", rel.PacketID, first.PacketID)
+	}
+	sub.expectNone()
+
+	// 尚未收到PUBREC的消息不接受PUBCOMP
+	sub.send(&mqtt.PubCompPacket{PacketID: first.PacketID + 1})
+	sub.expectNone()
+
+	sub.send(&mqtt.PubCompPacket{PacketID: first.PacketID})
+	second := sub.expectPublish("t", "m2", 2, false)
+	sub.send(&mqtt.PubRecPacket{PacketID: second.PacketID})
+	sub.decode(mqtt.PUBREL)
+	sub.send(&mqtt.PubCompPacket{PacketID: second.PacketID})
+	if inflight, pending := sessionState(m, "sub"); inflight != 0 || pending != 0 {
+		t.Fatalf("inflight=%d pending=%d after PUBCOMP", inflight, pending)
+	}
+}
+
+func TestResumeResendsWithDup(t *testing.T) {
+	m := newDeliveryManager(t, nil)
+	sub, _ := connectClient(t, m, mqtt.Version311, "sub", false, nil)
+	sub.subscribe(1, "t", 2)
+	pub, _ := connectClient(t, m, mqtt.Version311, "pub", true, nil)
+
+	pub.publishQoS1(1, "t", "m1")
+	pub.publishQoS2(2, "t", "m2")
+	pub.publishQoS2(3, "t", "m3")
+	first := sub.expectPublish("t", "m1", 1, false)
+	second := sub.expectPublish("t", "m2", 2, false)
+	third := sub.expectPublish("t", "m3", 2, false)
+	sub.send(&mqtt.PubRecPacket{PacketID: third.PacketID})
+	sub.decode(mqtt.PUBREL)
+	sub.drop()
+
+	// 重连后按原顺序重发：未确认的PUBLISH带DUP标志，已收到PUBREC的消息重发PUBREL
+	sub, present := connectClient(t, m, mqtt.Version311, "sub", false, nil)
+	if !present {
+		t.Fatal("session not present")
+	}
+	if p := sub.expectPublish("t", "m1", 1, true); p.PacketID != first.PacketID {
+		t.Fatalf("m1 resent with id %d, want %d", p.PacketID, first.PacketID)
+	}
+	if p := sub.expectPublish("t", "m2", 2, true); p.PacketID != second.PacketID {
+		t.Fatalf("m2 resent with id %d, want %d", p.PacketID, second.PacketID)
+	}
+	if rel := sub.decode(mqtt.PUBREL).(*mqtt.PubRelPacket); rel.PacketID != third.PacketID {
+		t.Fatalf("PUBREL for %d, want %d", rel.PacketID, third.PacketID)
+	}
+	sub.expectNone()
+}
+
+func TestOfflineQueue(t *testing.T) {
+	m := newDeliveryManager(t, nil)
+	sub, _ := connectClient(t, m, mqtt.Version311, "sub", false, nil)
+	sub.subscribe(1, "t", 1)
+	sub.drop()
+
+	// 离线期间只为持久会话保存QoS>0消息
+	pub, _ := connectClient(t, m, mqtt.Version311, "pub", true, nil)
+	pub.publishQoS1(1, "t", "q1")
+	pub.publish("t", "q0")
+	pub.publishQoS1(2, "t", "q2")
+	if inflight, pending := sessionState(m, "sub"); inflight != 0 || pending != 2 {
+		t.Fatalf("inflight=%d pending=%d while offline", inflight, pending)
+	}
+
+	// 排队的消息从未发送过，重连后不带DUP标志
+	sub, present := connectClient(t, m, mqtt.Version311, "sub", false, nil)
+	if !present {
+		t.Fatal("session not present")
+	}
+	sub.expectPublish("t", "q1", 1, false)
+	sub.expectPublish("t", "q2", 1, false)
+	sub.expectNone()
+
+	// 清理会话重连时丢弃排队的消息
+	sub.drop()
+	pub.publishQoS1(3, "t", "q3")
+	sub, present = connectClient(t, m, mqtt.Version311, "sub", true, nil)
+	if present {
+		t.Fatal("clean session reported as present")
+	}
+	sub.expectNone()
+}
+
+func TestSessionTakeover(t *testing.T) {
+	m := newDeliveryManager(t, nil)
+	props := &mqtt.Properties{SessionExpiryInterval: mqtt.Uint32(60)}
+	old, _ := connectClient(t, m, mqtt.Version5, "dev", false, props)
+	old.subscribe(1, "t", 1)
+	pub, _ := connectClient(t, m, mqtt.Version311, "pub", true, nil)
+	pub.publishQoS1(1, "t", "m1")
+	first := old.expectPublish("t", "m1", 1, false)
+
+	// 新连接接管会话，旧连接收到0x8E后被关闭，未确认的消息在新连接上重发
+	current, present := connectClient(t, m, mqtt.Version5, "dev", false, props)
+	if !present {
+		t.Fatal("session not present after takeover")
+	}
+	if d := old.decode(mqtt.DISCONNECT).(*mqtt.DisconnectPacket); d.ReasonCode != mqtt.ReasonSessionTakenOver {
+		t.Fatalf("DISCONNECT reason 0x%02x", d.ReasonCode)
+	}
+	old.expectClosed()
+	if p := current.expectPublish("t", "m1", 1, true); p.PacketID != first.PacketID {
+		t.Fatalf("resent with id %d, want %d", p.PacketID, first.PacketID)
+	}
+
+	// 旧连接随后关闭不影响新连接
+	old.drop()
+	pub.publishQoS1(2, "t", "m2")
+	current.expectPublish("t", "m2", 1, false)
+	old.expectNone()
+}
+
+func TestSharedSubscriptionFailover(t *testing.T) {
+	m := newDeliveryManager(t, nil)
+	a, _ := connectClient(t, m, mqtt.Version311, "a", true, nil)
+	a.subscribe(1, "$share/g/t", 1)
+	b, _ := connectClient(t, m, mqtt.Version311, "b", true, nil)
+	b.subscribe(1, "$share/g/t", 1)
+	pub, _ := connectClient(t, m, mqtt.Version311, "pub", true, nil)
+	pub.publishQoS1(1, "t", "m1")
+
+	var receiver, other *testClient
+	select {
+	case data := <-a.conn.written:
+		receiver, other = a, b
+		a.conn.written <- data
+	case data := <-b.conn.written:
+		receiver, other = b, a
+		b.conn.written <- data
+	case <-time.After(3 * time.Second):
+		t.Fatal("shared message not delivered")
+	}
+	receiver.expectPublish("t", "m1", 1, false)
+	other.expectNone()
+
+	// 成员未确认就断开时消息转交给组内其他成员
+	receiver.drop()
+	p := other.expectPublish("t", "m1", 1, false)
+	other.send(&mqtt.PubAckPacket{PacketID: p.PacketID})
+	other.expectNone()
+}
+
+func TestRetryInterval(t *testing.T) {
+	m := newDeliveryManager(t, func(c *Config) { c.RetryInterval = time.Nanosecond })
+	v3, _ := connectClient(t, m, mqtt.Version311, "v3", true, nil)
+	v3.subscribe(1, "t", 1)
+	v5, _ := connectClient(t, m, mqtt.Version5, "v5", true, nil)
+	v5.subscribe(1, "t", 1)
+	pub, _ := connectClient(t, m, mqtt.Version311, "pub", true, nil)
+	pub.publishQoS1(1, "t", "m1")
+	first := v3.expectPublish("t", "m1", 1, false)
+	v5.expectPublish("t", "m1", 1, false)
+
+	// MQTT 3.1.1按重发间隔重发，MQTT 5只在重连时重发
+	m.CheckTimeouts()
+	if p := v3.expectPublish("t", "m1", 1, true); p.PacketID != first.PacketID {
+		t.Fatalf("retried with id %d, want %d", p.PacketID, first.PacketID)
+	}
+	v5.expectNone()
+}
+
+func TestSendQueueFullKeepsMessagesPending(t *testing.T) {
+	const count = 150
+	m := newDeliveryManager(t, func(c *Config) { c.MaxInflight = 200 })
+	sub, _ := connectClient(t, m, mqtt.Version5, "sub", true, &mqtt.Properties{ReceiveMaximum: mqtt.Uint16(200)})
+	sub.subscribe(1, "t", 1)
+	pub, _ := connectClient(t, m, mqtt.Version311, "pub", true, nil)
+
+	// 订阅者不读取时发送队列被填满，未进入发送队列的消息不占用发送窗口
+	sub.conn.writing.Lock()
+	for i := 0; i < count; i++ {
+		pub.publishQoS1(uint16(i+1), "t", fmt.Sprint(i))
+	}
+	inflight, pending := sessionState(m, "sub")
+	if inflight+pending != count || pending == 0 {
+		t.Fatalf("inflight=%d pending=%d", inflight, pending)
+	}
+	sub.conn.writing.Unlock()
+
+	for i := 0; i < inflight; i++ {
+		sub.expectPublish("t", fmt.Sprint(i), 1, false)
+	}
+	sub.expectNone()
+
+	// 定时检查时补发，首次发送不带DUP标志
+	m.CheckTimeouts()
+	for i := inflight; i < count; i++ {
+		sub.expectPublish("t", fmt.Sprint(i), 1, false)
+	}
+	if inflight, pending := sessionState(m, "sub"); inflight != count || pending != 0 {
+		t.Fatalf("inflight=%d pending=%d after flush", inflight, pending)
+	}
+}
+
+func TestSessionExpiry(t *testing.T) {
+	m := newDeliveryManager(t, nil)
+	startManager(t, m)
+	props := &mqtt.Properties{SessionExpiryInterval: mqtt.Uint32(1)}
+	sub, _ := connectClient(t, m, mqtt.Version5, "sub", false, props)
+	sub.subscribe(1, "t", 1)
+	sub.drop()
+
+	pub, _ := connectClient(t, m, mqtt.Version311, "pub", true, nil)
+	pub.publishQoS1(1, "t", "m1")
+	if _, pending := sessionState(m, "sub"); pending != 1 {
+		t.Fatalf("pending=%d while offline", pending)
+	}
+
+	// 会话过期后删除会话及其订阅
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		if _, ok := m.sessions.Load("sub"); !ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("session not expired")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	sub, present := connectClient(t, m, mqtt.Version5, "sub", false, props)
+	if present {
+		t.Fatal("expired session reported as present")
+	}
+	pub.publishQoS1(2, "t", "m2")
+	sub.expectNone()
+}
+
+func TestSessionResumedBeforeExpiry(t *testing.T) {
+	m := newDeliveryManager(t, nil)
+	startManager(t, m)
+	props := &mqtt.Properties{SessionExpiryInterval: mqtt.Uint32(1)}
+	sub, _ := connectClient(t, m, mqtt.Version5, "sub", false, props)
+	sub.subscribe(1, "t", 1)
+	sub.drop()
+
+	// 过期前重连取消过期任务，之后再断开按新连接的间隔重新计时
+	sub, present := connectClient(t, m, mqtt.Version5, "sub", false, &mqtt.Properties{SessionExpiryInterval: mqtt.Uint32(60)})
+	if !present {
+		t.Fatal("session not present")
+	}
+	sub.drop()
+	time.Sleep(1500 * time.Millisecond)
+	if _, ok := m.sessions.Load("sub"); !ok {
+		t.Fatal("session expired with the old interval")
+	}
+}
+
+// connectWithWill 以设置了遗嘱延迟的持久会话连接
+func connectWithWill(t *testing.T, m *Manager, clientID string, delay uint32) *testClient {
+	t.Helper()
+	c := newTestClient(t, m, mqtt.Version5)
+	c.send(&mqtt.ConnectPacket{
+		ProtocolName:   []byte("MQTT"),
+		ProtocolLevel:  mqtt.Version5,
+		ClientID:       []byte(clientID),
+		Properties:     &mqtt.Properties{SessionExpiryInterval: mqtt.Uint32(60)},
+		WillFlag:       true,
+		WillTopic:      []byte("will/" + clientID),
+		WillMessage:    []byte("gone"),
+		WillProperties: &mqtt.Properties{WillDelayInterval: mqtt.Uint32(delay)},
+	})
+	if connAck := c.expect(mqtt.CONNACK); connAck[3] != mqtt.ReasonSuccess {
+		t.Fatalf("CONNACK reason 0x%02x", connAck[3])
+	}
+	return c
+}
+
+func TestWillDelay(t *testing.T) {
+	m := newDeliveryManager(t, nil)
+	startManager(t, m)
+	watcher, _ := connectClient(t, m, mqtt.Version311, "watcher", true, nil)
+	watcher.subscribe(1, "will/#", 0)
+
+	// 遗嘱在延迟后由调度器发布
+	connectWithWill(t, m, "w1", 1).drop()
+	dropped := time.Now()
+	watcher.expectNone()
+	watcher.expectPublish("will/w1", "gone", 0, false)
+	if elapsed := time.Since(dropped); elapsed < 900*time.Millisecond {
+		t.Fatalf("will published after %v", elapsed)
+	}
+
+	// 延迟期间恢复会话时不发布遗嘱
+	connectWithWill(t, m, "w2", 1).drop()
+	w2, present := connectClient(t, m, mqtt.Version5, "w2", false, &mqtt.Properties{SessionExpiryInterval: mqtt.Uint32(60)})
+	if !present {
+		t.Fatal("session not present")
+	}
+	watcher.expectNoneFor(1500 * time.Millisecond)
+
+	// 正常断开时丢弃遗嘱
+	w2.disconnect()
+	connectWithWill(t, m, "w3", 0).disconnect()
+	watcher.expectNone()
+}
@@ -0,0 +1,127 @@
+package broker
+
+import (
+	"hash/fnv"
+	"math/rand/v2"
+	"sort"
+	"strings"
+	"sync/atomic"
+
+	"busy-cloud/gnet-mqtt/types"
+)
+
+// sharePrefix 共享订阅主题过滤器前缀
+const sharePrefix = "$share/"
+
+// SharedStrategy 共享订阅的成员选择策略
+type SharedStrategy string
+
+const (
+	SharedRoundRobin    SharedStrategy = "round-robin"    // 轮询
+	SharedRandom        SharedStrategy = "random"         // 随机
+	SharedHash          SharedStrategy = "hash"           // 按发布者ClientID哈希
+	SharedLeastInflight SharedStrategy = "least-inflight" // 未确认消息最少
+)
+
+// subscriberStatus 订阅者状态查询接口，用于共享订阅选择成员
+type subscriberStatus interface {
+	isOnline(clientID string) bool
+	inflightCount(clientID string) int
+}
+
+// parseSharedFilter 解析 $share/<group>/<filter>，不是共享订阅时ok为false
+func parseSharedFilter(filter string) (group string, topicFilter string, ok bool) {
+	if !strings.HasPrefix(filter, sharePrefix) {
+		return "", "", false
+	}
+	group, topicFilter, _ = strings.Cut(filter[len(sharePrefix):], "/")
+	return group, topicFilter, true
+}
+
+// validSharedGroup 共享组名不能为空，也不能包含通配符
+func validSharedGroup(group string) bool {
+	return group != "" && !strings.ContainsAny(group, "+#")
+}
+
+// sharedGroup 共享订阅组，每条消息只投递给组内一个成员
+type sharedGroup struct {
+	name    string                         // 完整的共享订阅过滤器 $share/<group>/<filter>
+	members map[string]SubscriptionOptions // clientID -> 订阅选项
+	order   []string                       // 按ClientID排序的成员列表
+	next    atomic.Uint64                  // 轮询计数
+}
+
+func newSharedGroup(name string) *sharedGroup {
+	return &sharedGroup{
+		name:    name,
+		members: make(map[string]SubscriptionOptions),
+	}
+}
+
+// add 添加成员，返回是否为新成员
+func (g *sharedGroup) add(clientID string, options SubscriptionOptions) bool {
+	_, exists := g.members[clientID]
+	g.members[clientID] = options
+	if !exists {
+		i := sort.SearchStrings(g.order, clientID)
+		g.order = append(g.order, "")
+		copy(g.order[i+1:], g.order[i:])
+		g.order[i] = clientID
+	}
+	return !exists
+}
+
+// remove 删除成员，返回成员是否存在
+func (g *sharedGroup) remove(clientID string) bool {
+	if _, exists := g.members[clientID]; !exists {
+		return false
+	}
+	delete(g.members, clientID)
+	i := sort.SearchStrings(g.order, clientID)
+	g.order = append(g.order[:i], g.order[i+1:]...)
+	return true
+}
+
+// selectMember 按策略选择接收消息的成员，优先选择在线成员，exclude中的成员不参与选择
+func (g *sharedGroup) selectMember(strategy SharedStrategy, message *types.Message, status subscriberStatus, exclude string) (string, bool) {
+	candidates := make([]string, 0, len(g.order))
+	for _, clientID := range g.order {
+		if clientID != exclude && (status == nil || status.isOnline(clientID)) {
+			candidates = append(candidates, clientID)
+		}
+	}
+	// 没有在线成员时消息进入离线成员的会话队列
+	if len(candidates) == 0 {
+		for _, clientID := range g.order {
+			if clientID != exclude {
+				candidates = append(candidates, clientID)
+			}
+		}
+	}
+	if len(candidates) == 0 {
+		return "", false
+	}
+
+	switch strategy {
+	case SharedRandom:
+		return candidates[rand.IntN(len(candidates))], true
+	case SharedHash:
+		h := fnv.New32a()
+		h.Write(message.PublisherID)
+		return candidates[h.Sum32()%uint32(len(candidates))], true
+	case SharedLeastInflight:
+		if status != nil {
+			selected, least := candidates[0], status.inflightCount(candidates[0])
+			for _, clientID := range candidates[1:] {
+				if n := status.inflightCount(clientID); n < least {
+					selected, least = clientID, n
+				}
+			}
+			return selected, true
+		}
+	}
+
+	// 默认轮询
+	n := g.next.Add(1) - 1
+	return candidates[n%uint64(len(candidates))], true
+}
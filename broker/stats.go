@@ -0,0 +1,16 @@
+package broker
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// stats Broker运行统计
+type stats struct {
+	startTime        time.Time
+	clientsConnected atomic.Int64
+	messagesReceived atomic.Int64
+	messagesSent     atomic.Int64
+	bytesReceived    atomic.Int64
+	bytesSent        atomic.Int64
+}
@@ -0,0 +1,57 @@
+package broker
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"busy-cloud/gnet-mqtt/types"
+)
+
+// Version Broker版本
+const Version = "gnet-mqtt 0.1.0"
+
+// 系统状态主题
+const (
+	sysTopicRoot   = "$SYS"
+	sysTopicPrefix = sysTopicRoot + "/broker/"
+)
+
+// runSysPublisher 定期发布系统状态主题
+func (m *Manager) runSysPublisher(ctx context.Context) {
+	ticker := time.NewTicker(m.config.SysInterval)
+	defer ticker.Stop()
+
+	m.publishSysTopics()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			m.publishSysTopics()
+		}
+	}
+}
+
+// publishSysTopics 以保留消息发布当前系统状态
+func (m *Manager) publishSysTopics() {
+	uptime := int64(time.Since(m.stats.startTime).Seconds())
+
+	m.publishSys("version", Version)
+	m.publishSys("uptime", strconv.FormatInt(uptime, 10)+" seconds")
+	m.publishSys("clients/connected", strconv.FormatInt(m.stats.clientsConnected.Load(), 10))
+	m.publishSys("messages/received", strconv.FormatInt(m.stats.messagesReceived.Load(), 10))
+	m.publishSys("messages/sent", strconv.FormatInt(m.stats.messagesSent.Load(), 10))
+	m.publishSys("bytes/received", strconv.FormatInt(m.stats.bytesReceived.Load(), 10))
+	m.publishSys("bytes/sent", strconv.FormatInt(m.stats.bytesSent.Load(), 10))
+	m.publishSys("subscriptions/count", strconv.Itoa(m.router.SubscriptionCount()))
+	m.publishSys("retained messages/count", strconv.Itoa(m.router.RetainedCount()))
+}
+
+func (m *Manager) publishSys(name string, value string) {
+	m.router.RouteMessage(&types.Message{
+		Topic:   []byte(sysTopicPrefix + name),
+		Payload: []byte(value),
+		Retain:  true,
+	})
+}
@@ -0,0 +1,67 @@
+package broker
+
+import "busy-cloud/gnet-mqtt/mqtt"
+
+// topicAliases 连接的主题别名表，别名只在单个网络连接内有效
+type topicAliases struct {
+	inbound     map[uint16][]byte // 客户端发布时使用的别名
+	inboundMax  uint16            // CONNACK中通告的Topic Alias Maximum
+	outbound    map[string]uint16 // 向客户端投递时分配的别名
+	outboundMax uint16            // 客户端CONNECT中的Topic Alias Maximum
+}
+
+// newTopicAliases 创建主题别名表，最大值为0表示不使用该方向的别名
+func newTopicAliases(inboundMax, outboundMax uint16) *topicAliases {
+	return &topicAliases{
+		inbound:     make(map[uint16][]byte),
+		inboundMax:  inboundMax,
+		outbound:    make(map[string]uint16),
+		outboundMax: outboundMax,
+	}
+}
+
+// resolve 处理入站PUBLISH的主题别名，返回实际主题，失败时返回断开连接的原因码
+func (a *topicAliases) resolve(topic []byte, props *mqtt.Properties) ([]byte, byte) {
+	if props == nil || props.TopicAlias == nil {
+		if len(topic) == 0 {
+			return nil, mqtt.ReasonProtocolError
+		}
+		return topic, mqtt.ReasonSuccess
+	}
+
+	alias := *props.TopicAlias
+	if alias == 0 || alias > a.inboundMax {
+		return nil, mqtt.ReasonTopicAliasInvalid
+	}
+
+	// 主题名为空时使用已建立的别名，否则建立或更新别名
+	if len(topic) == 0 {
+		topic, ok := a.inbound[alias]
+		if !ok {
+			return nil, mqtt.ReasonProtocolError
+		}
+		return topic, mqtt.ReasonSuccess
+	}
+	a.inbound[alias] = topic
+	return topic, mqtt.ReasonSuccess
+}
+
+// assign 为出站主题查找别名或选出下一个可用别名，别名已建立时known为true，别名用尽时返回0
+// 新别名在携带它的报文发送成功后才通过commit建立
+func (a *topicAliases) assign(topic []byte) (alias uint16, known bool) {
+	if a.outboundMax == 0 {
+		return 0, false
+	}
+	if alias, ok := a.outbound[string(topic)]; ok {
+		return alias, true
+	}
+	if len(a.outbound) >= int(a.outboundMax) {
+		return 0, false
+	}
+	return uint16(len(a.outbound) + 1), false
+}
+
+// commit 建立已随报文发送给客户端的别名
+func (a *topicAliases) commit(topic []byte, alias uint16) {
+	a.outbound[string(topic)] = alias
+}
@@ -0,0 +1,287 @@
+package broker
+
+import (
+	"strings"
+)
+
+// topicNode 订阅树节点，每个节点对应主题过滤器的一个层级
+type topicNode struct {
+	children    map[string]*topicNode          // 普通层级子节点
+	plus        *topicNode                     // "+" 单层通配符子节点
+	hash        *topicNode                     // "#" 多层通配符子节点
+	subscribers map[string]SubscriptionOptions // clientID -> 订阅选项
+	shared      map[string]*sharedGroup        // group -> 共享订阅组
+}
+
+func newTopicNode() *topicNode {
+	return &topicNode{}
+}
+
+// child 获取层级对应的子节点
+func (n *topicNode) child(level string) *topicNode {
+	switch level {
+	case "+":
+		return n.plus
+	case "#":
+		return n.hash
+	default:
+		return n.children[level]
+	}
+}
+
+// childOrCreate 获取或创建层级对应的子节点
+func (n *topicNode) childOrCreate(level string) *topicNode {
+	switch level {
+	case "+":
+		if n.plus == nil {
+			n.plus = newTopicNode()
+		}
+		return n.plus
+	case "#":
+		if n.hash == nil {
+			n.hash = newTopicNode()
+		}
+		return n.hash
+	default:
+		if n.children == nil {
+			n.children = make(map[string]*topicNode)
+		}
+		c, ok := n.children[level]
+		if !ok {
+			c = newTopicNode()
+			n.children[level] = c
+		}
+		return c
+	}
+}
+
+// removeChild 删除层级对应的子节点
+func (n *topicNode) removeChild(level string) {
+	switch level {
+	case "+":
+		n.plus = nil
+	case "#":
+		n.hash = nil
+	default:
+		delete(n.children, level)
+	}
+}
+
+// empty 节点是否既无订阅者也无子节点
+func (n *topicNode) empty() bool {
+	return len(n.subscribers) == 0 && len(n.shared) == 0 &&
+		len(n.children) == 0 && n.plus == nil && n.hash == nil
+}
+
+// topicTree 按层级索引的订阅树
+type topicTree struct {
+	root  *topicNode
+	count int // 订阅关系总数
+}
+
+func newTopicTree() *topicTree {
+	return &topicTree{root: newTopicNode()}
+}
+
+// nextLevel 返回主题的第一个层级及剩余部分，没有剩余层级时more为false
+func nextLevel(topic string) (level string, rest string, more bool) {
+	if i := strings.IndexByte(topic, '/'); i >= 0 {
+		return topic[:i], topic[i+1:], true
+	}
+	return topic, "", false
+}
+
+// validTopicFilter 校验主题过滤器的通配符用法
+func validTopicFilter(filter string) bool {
+	if filter == "" {
+		return false
+	}
+	rest, more := filter, true
+	for more {
+		var level string
+		level, rest, more = nextLevel(rest)
+		if strings.ContainsAny(level, "+#") && len(level) > 1 {
+			return false
+		}
+		// "#" 只能是最后一个层级
+		if level == "#" && more {
+			return false
+		}
+	}
+	return true
+}
+
+// node 查找主题过滤器对应的节点，create为true时创建缺失的节点
+func (t *topicTree) node(filter string, create bool) *topicNode {
+	node := t.root
+	rest, more := filter, true
+	for more && node != nil {
+		var level string
+		level, rest, more = nextLevel(rest)
+		if create {
+			node = node.childOrCreate(level)
+		} else {
+			node = node.child(level)
+		}
+	}
+	return node
+}
+
+// add 添加订阅，返回是否为新增订阅关系
+func (t *topicTree) add(filter string, clientID string, options SubscriptionOptions) bool {
+	node := t.node(filter, true)
+	if node.subscribers == nil {
+		node.subscribers = make(map[string]SubscriptionOptions)
+	}
+	_, exists := node.subscribers[clientID]
+	node.subscribers[clientID] = options
+	if !exists {
+		t.count++
+	}
+	return !exists
+}
+
+// addShared 添加共享订阅，返回是否为新增订阅关系
+func (t *topicTree) addShared(name string, group string, filter string, clientID string, options SubscriptionOptions) bool {
+	node := t.node(filter, true)
+	if node.shared == nil {
+		node.shared = make(map[string]*sharedGroup)
+	}
+	g, ok := node.shared[group]
+	if !ok {
+		g = newSharedGroup(name)
+		node.shared[group] = g
+	}
+	added := g.add(clientID, options)
+	if added {
+		t.count++
+	}
+	return added
+}
+
+// findShared 查找共享订阅组
+func (t *topicTree) findShared(group string, filter string) *sharedGroup {
+	node := t.node(filter, false)
+	if node == nil {
+		return nil
+	}
+	return node.shared[group]
+}
+
+// remove 删除订阅并清理空节点，返回订阅关系是否存在
+func (t *topicTree) remove(filter string, clientID string) bool {
+	return t.removeWith(filter, func(node *topicNode) bool {
+		if _, ok := node.subscribers[clientID]; !ok {
+			return false
+		}
+		delete(node.subscribers, clientID)
+		return true
+	})
+}
+
+// removeShared 删除共享订阅并清理空节点，返回订阅关系是否存在
+func (t *topicTree) removeShared(group string, filter string, clientID string) bool {
+	return t.removeWith(filter, func(node *topicNode) bool {
+		g, ok := node.shared[group]
+		if !ok || !g.remove(clientID) {
+			return false
+		}
+		if len(g.members) == 0 {
+			delete(node.shared, group)
+		}
+		return true
+	})
+}
+
+func (t *topicTree) removeWith(filter string, removeAt func(node *topicNode) bool) bool {
+	removed := t.removeFrom(t.root, filter, removeAt)
+	if removed {
+		t.count--
+	}
+	return removed
+}
+
+func (t *topicTree) removeFrom(node *topicNode, filter string, removeAt func(node *topicNode) bool) bool {
+	level, rest, more := nextLevel(filter)
+	c := node.child(level)
+	if c == nil {
+		return false
+	}
+
+	var removed bool
+	if more {
+		removed = t.removeFrom(c, rest, removeAt)
+	} else {
+		removed = removeAt(c)
+	}
+
+	if removed && c.empty() {
+		node.removeChild(level)
+	}
+	return removed
+}
+
+// match 查找与主题匹配的所有节点，对每个节点调用fn
+func (t *topicTree) match(topic string, fn func(node *topicNode)) {
+	// 以$开头的主题不能被首层通配符匹配
+	t.matchNode(t.root, topic, !strings.HasPrefix(topic, "$"), fn)
+}
+
+func (t *topicTree) matchNode(node *topicNode, topic string, wildcards bool, fn func(node *topicNode)) {
+	level, rest, more := nextLevel(topic)
+
+	if wildcards {
+		// "#" 匹配当前层级及其后所有层级
+		if node.hash != nil {
+			fn(node.hash)
+		}
+		if node.plus != nil {
+			t.matchLevel(node.plus, rest, more, fn)
+		}
+	}
+
+	if c := node.children[level]; c != nil {
+		t.matchLevel(c, rest, more, fn)
+	}
+}
+
+// matchLevel 在已匹配一个层级的节点上继续匹配剩余主题
+func (t *topicTree) matchLevel(node *topicNode, rest string, more bool, fn func(node *topicNode)) {
+	if more {
+		t.matchNode(node, rest, true, fn)
+		return
+	}
+
+	fn(node)
+	// "sport/#" 同时匹配父级 "sport"
+	if node.hash != nil {
+		fn(node.hash)
+	}
+}
+
+// walk 遍历所有订阅节点，fn的filter参数为完整主题过滤器
+func (t *topicTree) walk(fn func(filter string, node *topicNode)) {
+	t.walkNode(t.root, "", true, fn)
+}
+
+func (t *topicTree) walkNode(node *topicNode, prefix string, root bool, fn func(filter string, node *topicNode)) {
+	join := func(level string) string {
+		if root {
+			return level
+		}
+		return prefix + "/" + level
+	}
+
+	if !root && (len(node.subscribers) > 0 || len(node.shared) > 0) {
+		fn(prefix, node)
+	}
+	for level, c := range node.children {
+		t.walkNode(c, join(level), false, fn)
+	}
+	if node.plus != nil {
+		t.walkNode(node.plus, join("+"), false, fn)
+	}
+	if node.hash != nil {
+		t.walkNode(node.hash, join("#"), false, fn)
+	}
+}
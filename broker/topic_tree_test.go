@@ -0,0 +1,164 @@
+package broker
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// matchedClients 返回与主题匹配的订阅者
+func matchedClients(t *topicTree, topic string) []string {
+	var clients []string
+	t.match(topic, func(node *topicNode) {
+		for clientID := range node.subscribers {
+			clients = append(clients, clientID)
+		}
+	})
+	sort.Strings(clients)
+	return clients
+}
+
+func TestTopicTreeMatch(t *testing.T) {
+	tests := []struct {
+		filter string
+		topic  string
+		match  bool
+	}{
+		{"sport/tennis/player1", "sport/tennis/player1", true},
+		{"sport/tennis/player1", "sport/tennis/player2", false},
+		{"sport/tennis/+", "sport/tennis/player1", true},
+		{"sport/tennis/+", "sport/tennis/player1/ranking", false},
+		{"sport/tennis/+", "sport/tennis", false},
+		{"sport/+", "sport/", true},
+		{"+/+", "/finance", true},
+		{"/+", "/finance", true},
+		{"+", "/finance", false},
+		{"sport/#", "sport/tennis/player1", true},
+		{"sport/#", "sport", true},
+		{"sport/tennis/#", "sport/tennis", true},
+		{"sport/tennis/#", "sport", false},
+		{"#", "sport/tennis", true},
+		{"#", "/", true},
+		{"+/tennis/#", "sport/tennis", true},
+		{"#", "$SYS/broker/uptime", false},
+		{"+/broker/uptime", "$SYS/broker/uptime", false},
+		{"$SYS/#", "$SYS/broker/uptime", true},
+		{"$SYS/+/uptime", "$SYS/broker/uptime", true},
+	}
+
+	for _, tt := range tests {
+		tree := newTopicTree()
+		tree.add(tt.filter, "c", SubscriptionOptions{})
+		got := len(matchedClients(tree, tt.topic)) == 1
+		if got != tt.match {
+			t.Errorf("filter %q topic %q: match = %v, want %v", tt.filter, tt.topic, got, tt.match)
+		}
+	}
+}
+
+func TestTopicTreeMatchMultipleFilters(t *testing.T) {
+	tree := newTopicTree()
+	tree.add("a/b", "exact", SubscriptionOptions{})
+	tree.add("a/+", "plus", SubscriptionOptions{})
+	tree.add("a/#", "hash", SubscriptionOptions{})
+	tree.add("#", "all", SubscriptionOptions{})
+	tree.add("b/#", "other", SubscriptionOptions{})
+
+	got := strings.Join(matchedClients(tree, "a/b"), ",")
+	if want := "all,exact,hash,plus"; got != want {
+		t.Errorf("a/b matched %q, want %q", got, want)
+	}
+	got = strings.Join(matchedClients(tree, "a"), ",")
+	if want := "all,hash"; got != want {
+		t.Errorf("a matched %q, want %q", got, want)
+	}
+}
+
+func TestTopicTreeRemovePrunesNodes(t *testing.T) {
+	tree := newTopicTree()
+	tree.add("a/b/c", "c1", SubscriptionOptions{})
+	tree.add("a/+/#", "c1", SubscriptionOptions{})
+
+	if !tree.remove("a/b/c", "c1") || !tree.remove("a/+/#", "c1") {
+		t.Fatal("remove returned false for existing subscriptions")
+	}
+	if tree.remove("a/b/c", "c1") {
+		t.Error("remove returned true for a missing subscription")
+	}
+	if !tree.root.empty() || tree.count != 0 {
+		t.Errorf("tree not empty after removing all subscriptions, count = %d", tree.count)
+	}
+}
+
+// linearScan 替换前的订阅表：遍历所有过滤器逐个匹配
+type linearScan map[string]map[string]byte
+
+func (s linearScan) match(topic string) []string {
+	var clients []string
+	for filter, subscribers := range s {
+		if linearMatchTopic(topic, filter) {
+			for clientID := range subscribers {
+				clients = append(clients, clientID)
+			}
+		}
+	}
+	return clients
+}
+
+// linearMatchTopic 替换前Router.matchTopic的实现
+func linearMatchTopic(topic string, filter string) bool {
+	topicParts := strings.Split(topic, "/")
+	filterParts := strings.Split(filter, "/")
+
+	for i := 0; i < len(filterParts) && i < len(topicParts); i++ {
+		if filterParts[i] == "#" {
+			return true
+		}
+		if filterParts[i] != "+" && filterParts[i] != topicParts[i] {
+			return false
+		}
+	}
+
+	return len(topicParts) == len(filterParts)
+}
+
+// benchmarkFilters 设备专属过滤器及少量通配符过滤器
+func benchmarkFilters(n int) []string {
+	filters := make([]string, 0, n+3)
+	for i := 0; i < n; i++ {
+		filters = append(filters, fmt.Sprintf("devices/%d/telemetry", i))
+	}
+	return append(filters, "devices/+/status", "devices/#", "alerts/#")
+}
+
+func BenchmarkRouteMatch(b *testing.B) {
+	for _, n := range []int{10000, 50000} {
+		filters := benchmarkFilters(n)
+		topic := fmt.Sprintf("devices/%d/telemetry", n/2)
+
+		b.Run(fmt.Sprintf("trie/%d", n), func(b *testing.B) {
+			tree := newTopicTree()
+			for i, filter := range filters {
+				tree.add(filter, fmt.Sprintf("c%d", i), SubscriptionOptions{})
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				matchedClients(tree, topic)
+			}
+		})
+
+		b.Run(fmt.Sprintf("linear/%d", n), func(b *testing.B) {
+			scan := make(linearScan)
+			for i, filter := range filters {
+				scan[filter] = map[string]byte{fmt.Sprintf("c%d", i): 0}
+			}
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				scan.match(topic)
+			}
+		})
+	}
+}
@@ -1,18 +1,25 @@
 package main
 
 import (
+	"errors"
 	"time"
 
 	"busy-cloud/gnet-mqtt/broker"
 	"busy-cloud/gnet-mqtt/mqtt"
 	"busy-cloud/gnet-mqtt/network"
+	"busy-cloud/gnet-mqtt/types"
 	"github.com/panjf2000/gnet/v2"
 )
 
 type Handler struct {
 	eng    gnet.Engine
 	broker *broker.Manager
-	codec  mqtt.MQTTCodec
+}
+
+// connContext gnet连接上下文，保存连接包装器和该连接自己的编解码状态
+type connContext struct {
+	conn  types.Conn
+	codec *mqtt.MQTTCodec
 }
 
 func (h *Handler) OnBoot(eng gnet.Engine) (action gnet.Action) {
@@ -25,40 +32,58 @@ func (h *Handler) OnShutdown(eng gnet.Engine) {
 }
 
 func (h *Handler) OnOpen(c gnet.Conn) (out []byte, action gnet.Action) {
-	// 创建Gnet连接包装器并添加到broker
-	gnetConn := network.NewGNetConn(c)
-	h.broker.AddClient(gnetConn, "gnet")
+	// 创建Gnet连接包装器并添加到broker，包装器保存在连接上下文中以保持连接标识一致
+	ctx := &connContext{
+		conn:  network.NewGNetConn(c),
+		codec: mqtt.NewMQTTCodec(h.broker.MaxPacketSize()),
+	}
+	c.SetContext(ctx)
+	h.broker.AddClient(ctx.conn, "gnet")
 	return nil, gnet.None
 }
 
 func (h *Handler) OnClose(c gnet.Conn, err error) (action gnet.Action) {
-	gnetConn := network.NewGNetConn(c)
-	h.broker.RemoveClient(gnetConn)
+	ctx, ok := c.Context().(*connContext)
+	if !ok {
+		return gnet.None
+	}
+	h.broker.RemoveClient(ctx.conn)
 	return gnet.None
 }
 
 func (h *Handler) OnTraffic(c gnet.Conn) (action gnet.Action) {
-	// 使用编解码器处理数据
-	packetData, err := h.codec.Decode(c)
-	if err != nil {
+	ctx, ok := c.Context().(*connContext)
+	if !ok {
 		return gnet.Close
 	}
 
-	if packetData == nil {
-		return gnet.None
-	}
+	// 一次读事件可能包含多个报文，处理所有完整的报文，不完整的部分留在连接的编解码器中
+	for {
+		packetData, err := ctx.codec.Decode(c)
+		// 超过最大报文长度的报文在缓存前被丢弃，由Broker断开连接
+		var tooLarge *mqtt.PacketTooLargeError
+		if errors.As(err, &tooLarge) {
+			h.broker.AcceptPacketSize(ctx.conn, tooLarge.Size)
+			return gnet.None
+		}
+		if err != nil {
+			return gnet.Close
+		}
 
-	// 解析MQTT报文
-	packet, err := mqtt.DecodePacket(packetData)
-	if err != nil {
-		return gnet.Close
-	}
+		if packetData == nil {
+			return gnet.None
+		}
+		h.broker.AddBytesReceived(len(packetData))
 
-	// 处理报文
-	gnetConn := network.NewGNetConn(c)
-	h.broker.HandlePacket(gnetConn, packet)
+		// 按连接协商的协议版本解析MQTT报文
+		packet, err := mqtt.DecodePacket(packetData, h.broker.ProtocolVersion(ctx.conn))
+		if err != nil {
+			return gnet.Close
+		}
 
-	return gnet.None
+		// 处理报文
+		h.broker.HandlePacket(ctx.conn, packet)
+	}
 }
 
 func (h *Handler) OnTick() (delay time.Duration, action gnet.Action) {
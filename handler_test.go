@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"busy-cloud/gnet-mqtt/broker"
+	"busy-cloud/gnet-mqtt/mqtt"
+	"github.com/panjf2000/gnet/v2"
+)
+
+// testConn 内存中的gnet.Conn，只实现Handler和GNetConn用到的方法
+type testConn struct {
+	gnet.Conn
+	id      int
+	ctx     any
+	inbound []byte
+
+	mu       sync.Mutex
+	outbound bytes.Buffer
+	closed   bool
+}
+
+func (c *testConn) Context() any         { return c.ctx }
+func (c *testConn) SetContext(ctx any)   { c.ctx = ctx }
+func (c *testConn) InboundBuffered() int { return len(c.inbound) }
+
+func (c *testConn) Next(n int) ([]byte, error) {
+	if n < 0 || n > len(c.inbound) {
+		n = len(c.inbound)
+	}
+	buf := c.inbound[:n]
+	c.inbound = c.inbound[n:]
+	return buf, nil
+}
+
+func (c *testConn) AsyncWrite(buf []byte, callback gnet.AsyncCallback) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.outbound.Write(buf)
+	return nil
+}
+
+func (c *testConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	return nil
+}
+
+func (c *testConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 10000 + c.id}
+}
+
+// received 解析发往客户端的数据，统计PUBLISH报文数量
+func (c *testConn) received(t *testing.T) int {
+	c.mu.Lock()
+	data := append([]byte(nil), c.outbound.Bytes()...)
+	c.mu.Unlock()
+
+	count := 0
+	reader := mqtt.NewPacketReader(bytes.NewReader(data), 0)
+	for {
+		packet, err := reader.ReadPacket()
+		if err == io.EOF {
+			return count
+		}
+		if err != nil {
+			t.Errorf("client %d: malformed outbound stream: %v", c.id, err)
+			return count
+		}
+		if packet[0]>>4 == mqtt.PUBLISH {
+			count++
+		}
+	}
+}
+
+func u16(b []byte) []byte {
+	return append([]byte{byte(len(b) >> 8), byte(len(b))}, b...)
+}
+
+// clientStream 客户端连接、订阅自己的主题并发布若干条消息的字节流
+func clientStream(id int, messages int, rnd *rand.Rand) []byte {
+	clientID := []byte(fmt.Sprintf("client-%d", id))
+	topic := []byte(fmt.Sprintf("race/%d", id))
+
+	connect := append(u16([]byte("MQTT")), mqtt.Version311, 0x02, 0x00, 0x3c)
+	stream := mqtt.CreatePacket(mqtt.CONNECT, connect, u16(clientID))
+	stream = append(stream, byte(mqtt.SUBSCRIBE<<4|0x02))
+	subscribe := append([]byte{0x00, 0x01}, u16(topic)...)
+	subscribe = append(subscribe, 0x00)
+	stream = append(stream, byte(len(subscribe)))
+	stream = append(stream, subscribe...)
+	for i := 0; i < messages; i++ {
+		payload := bytes.Repeat([]byte{byte('a' + i%26)}, 1+rnd.Intn(400))
+		stream = append(stream, mqtt.CreatePacket(mqtt.PUBLISH, u16(topic), payload)...)
+	}
+	return stream
+}
+
+// TestHandlerConcurrentTraffic 多个连接并发地以拆分和粘连的数据块驱动OnTraffic，配合 go test -race 使用
+func TestHandlerConcurrentTraffic(t *testing.T) {
+	const clients = 64
+	const messages = 20
+
+	manager := broker.NewManager(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	handler := &Handler{broker: manager}
+
+	conns := make([]*testConn, clients)
+	var wg sync.WaitGroup
+	for i := range conns {
+		conn := &testConn{id: i}
+		conns[i] = conn
+
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(seed))
+			handler.OnOpen(conn)
+
+			// 同一连接的事件串行处理，与gnet事件循环一致
+			stream := clientStream(conn.id, messages, rnd)
+			for len(stream) > 0 {
+				n := 1 + rnd.Intn(700)
+				if n > len(stream) {
+					n = len(stream)
+				}
+				conn.inbound = append(conn.inbound, stream[:n]...)
+				stream = stream[n:]
+				if action := handler.OnTraffic(conn); action != gnet.None {
+					t.Errorf("client %d: OnTraffic returned %v", conn.id, action)
+					return
+				}
+			}
+		}(int64(i))
+	}
+	wg.Wait()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for _, conn := range conns {
+		for conn.received(t) < messages && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if got := conn.received(t); got != messages {
+			t.Errorf("client %d received %d messages, want %d", conn.id, got, messages)
+		}
+	}
+
+	for _, conn := range conns {
+		handler.OnClose(conn, nil)
+	}
+}
@@ -12,6 +12,12 @@ import (
 	"busy-cloud/gnet-mqtt/network"
 )
 
+// server 可启动和停止的监听服务
+type server interface {
+	Start(ctx context.Context) error
+	Stop() error
+}
+
 func main() {
 	// 初始化slog日志
 	logger := slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{
@@ -19,8 +25,13 @@ func main() {
 	}))
 	slog.SetDefault(logger)
 
-	// 创建Broker管理器
-	brokerManager := broker.NewManager(logger)
+	// 创建Broker管理器，可使用客户端证书中的CN/SAN作为ClientID或用户名
+	config := broker.DefaultConfig()
+	config.CertClientID = broker.CertIdentity(os.Getenv("MQTT_CERT_CLIENT_ID"))
+	config.CertUsername = broker.CertIdentity(os.Getenv("MQTT_CERT_USERNAME"))
+	// 设置响应主题前缀后为请求响应信息的客户端返回<前缀>/<ClientID>/
+	config.ResponseTopicPrefix = os.Getenv("MQTT_RESPONSE_TOPIC_PREFIX")
+	brokerManager := broker.NewManagerWithConfig(config, logger)
 
 	// 创建网络处理器（用于标准TCP和WebSocket）
 	netHandler := network.NewMQTTConnectionHandler(brokerManager, logger)
@@ -31,6 +42,26 @@ func main() {
 	// 创建WebSocket服务器
 	wsServer := network.NewWebSocketServer(":1884", netHandler, logger)
 
+	// 配置了证书时创建TLS服务器：gnet TLS、WSS和标准TLS
+	var tlsServers []server
+	if certFile := os.Getenv("MQTT_TLS_CERT"); certFile != "" {
+		tlsConfig, err := network.NewTLSConfig(network.TLSConfig{
+			CertFile:          certFile,
+			KeyFile:           os.Getenv("MQTT_TLS_KEY"),
+			ClientCAFile:      os.Getenv("MQTT_TLS_CLIENT_CA"),
+			RequireClientCert: os.Getenv("MQTT_TLS_REQUIRE_CLIENT_CERT") == "true",
+		})
+		if err != nil {
+			slog.Error("Failed to load TLS config", "error", err)
+			return
+		}
+		tlsServers = append(tlsServers,
+			network.NewGNetTLSServer(":8883", tlsConfig, netHandler, logger),
+			network.NewWebSocketTLSServer(":8884", tlsConfig, netHandler, logger),
+			network.NewTLSServer(":8885", tlsConfig, netHandler, logger),
+		)
+	}
+
 	// 创建Gnet handler
 	gnetHandler := &Handler{
 		broker: brokerManager,
@@ -42,6 +73,9 @@ func main() {
 
 	slog.Info("Starting MQTT Broker with multiple protocols...")
 
+	// 启动Broker后台任务
+	brokerManager.Start(ctx)
+
 	// 启动标准TCP服务器（goroutine）
 	go func() {
 		if err := tcpServer.Start(ctx); err != nil {
@@ -56,33 +90,60 @@ func main() {
 		}
 	}()
 
+	// 启动TLS服务器
+	for _, s := range tlsServers {
+		if err := s.Start(ctx); err != nil {
+			slog.Error("TLS server failed", "error", err)
+		}
+	}
+
 	slog.Info("MQTT Broker started successfully",
 		"gnet_tcp", 1883,
 		"std_tcp", 1885,
 		"websocket", 1884)
 
-	// 启动Gnet服务器（主服务器，阻塞）
+	// 注册信号处理：SIGINT/SIGTERM优雅关闭，SIGUSR1将客户端重定向到MQTT_REDIRECT_SERVER，SIGUSR2取消重定向
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM, syscall.SIGUSR1, syscall.SIGUSR2)
+	go func() {
+		for sig := range sigChan {
+			switch sig {
+			case syscall.SIGUSR1:
+				brokerManager.Redirect(os.Getenv("MQTT_REDIRECT_SERVER"), os.Getenv("MQTT_REDIRECT_MOVED") == "true")
+				continue
+			case syscall.SIGUSR2:
+				brokerManager.Redirect("", false)
+				continue
+			}
+
+			slog.Info("Shutting down MQTT Broker...")
+
+			// 优雅关闭：先向客户端发送DISCONNECT，再停止各服务器
+			brokerManager.Shutdown()
+			tcpServer.Stop()
+			wsServer.Stop()
+			for _, s := range tlsServers {
+				s.Stop()
+			}
+			if err := gnetHandler.eng.Stop(context.Background()); err != nil {
+				slog.Error("Failed to stop gnet server", "error", err)
+			}
+			return
+		}
+	}()
+
+	// 启动Gnet服务器（主服务器，阻塞直到停止）
 	err := gnet.Run(gnetHandler,
 		"tcp://:1883",
 		gnet.WithMulticore(true),
 		gnet.WithReusePort(true),
 		gnet.WithTCPNoDelay(gnet.TCPNoDelay),
+		gnet.WithTicker(true),
 	)
 	if err != nil {
 		slog.Error("Gnet server failed", "error", err)
 		return
 	}
-
-	// 等待中断信号
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
-
-	<-sigChan
-	slog.Info("Shutting down MQTT Broker...")
-
-	// 优雅关闭
-	tcpServer.Stop()
-	wsServer.Stop()
 	cancel()
 
 	slog.Info("MQTT Broker stopped")
@@ -7,9 +7,16 @@ import (
 	"github.com/panjf2000/gnet/v2"
 )
 
-// MQTTCodec MQTT协议编解码器
+// MQTTCodec MQTT协议编解码器，缓存未完整的报文，每个连接需要独立的实例
 type MQTTCodec struct {
-	buffer bytes.Buffer
+	buffer  bytes.Buffer
+	maxSize int // 最大报文长度，0表示不限制
+	discard int // 超长报文尚未到达、需要丢弃的字节数
+}
+
+// NewMQTTCodec 创建编解码器，maxSize为0时不限制报文长度
+func NewMQTTCodec(maxSize int) *MQTTCodec {
+	return &MQTTCodec{maxSize: maxSize}
 }
 
 // Encode 编码
@@ -18,9 +25,16 @@ func (mc *MQTTCodec) Encode(c gnet.Conn, buf []byte) ([]byte, error) {
 }
 
 // Decode 解码 - 处理TCP粘包
+// 超过最大长度的报文在缓存前被丢弃，返回*PacketTooLargeError，之后可以继续解码
 func (mc *MQTTCodec) Decode(c gnet.Conn) ([]byte, error) {
 	if c.InboundBuffered() > 0 {
 		buf, _ := c.Next(-1)
+		// 丢弃超长报文的剩余部分
+		if mc.discard > 0 {
+			n := min(mc.discard, len(buf))
+			mc.discard -= n
+			buf = buf[n:]
+		}
 		mc.buffer.Write(buf)
 	}
 
@@ -31,11 +45,22 @@ func (mc *MQTTCodec) Decode(c gnet.Conn) ([]byte, error) {
 			return nil, nil
 		}
 
-		totalLength, err := mc.parsePacketLength(data)
+		totalLength, err := parsePacketLength(data)
 		if err != nil {
 			return nil, err
 		}
 
+		// 剩余长度字段完整后即检查长度，不等待报文全部到达
+		if mc.maxSize > 0 && totalLength > mc.maxSize {
+			if len(data) >= totalLength {
+				mc.buffer.Next(totalLength)
+			} else {
+				mc.discard = totalLength - len(data)
+				mc.buffer.Reset()
+			}
+			return nil, &PacketTooLargeError{Size: totalLength}
+		}
+
 		if totalLength > 0 && len(data) >= totalLength {
 			packet := make([]byte, totalLength)
 			copy(packet, data[:totalLength])
@@ -47,10 +72,10 @@ func (mc *MQTTCodec) Decode(c gnet.Conn) ([]byte, error) {
 	return nil, nil
 }
 
-// parsePacketLength 解析MQTT包总长度
-func (mc *MQTTCodec) parsePacketLength(data []byte) (int, error) {
+// parsePacketLength 解析MQTT包总长度，剩余长度字段不完整时返回0
+func parsePacketLength(data []byte) (int, error) {
 	if len(data) < 2 {
-		return 0, ErrMalformedPacket
+		return 0, nil
 	}
 
 	pos := 1
@@ -59,17 +84,18 @@ func (mc *MQTTCodec) parsePacketLength(data []byte) (int, error) {
 
 	for {
 		if pos >= len(data) {
-			return 0, ErrMalformedPacket
+			return 0, nil
 		}
 
 		encodedByte := data[pos]
 		value += int(encodedByte&127) * multiplier
-		multiplier *= 128
 		pos++
 
+		// 剩余长度最多4字节
 		if multiplier > 128*128*128 {
 			return 0, ErrInvalidLength
 		}
+		multiplier *= 128
 
 		if (encodedByte & 128) == 0 {
 			break
@@ -121,17 +147,22 @@ func encodeLength(length int) []byte {
 	return encoded
 }
 
-// CreateConnAck 创建CONNACK包
-func CreateConnAck(sessionPresent bool, returnCode byte) []byte {
+// CreateConnAck 创建CONNACK包，MQTT 5.0时携带属性
+func CreateConnAck(version byte, sessionPresent bool, returnCode byte, props *Properties) []byte {
 	var payload []byte
 
+	// MQTT 3.1 没有会话存在标志
 	ackFlags := byte(0)
-	if sessionPresent {
+	if sessionPresent && version != Version31 {
 		ackFlags |= 0x01
 	}
 	payload = append(payload, ackFlags)
 	payload = append(payload, returnCode)
 
+	if version == Version5 {
+		payload = append(payload, encodeProperties(props)...)
+	}
+
 	return CreatePacket(CONNACK, payload)
 }
 
@@ -141,18 +172,123 @@ func CreatePingResp() []byte {
 }
 
 // CreateSubAck 创建SUBACK包
-func CreateSubAck(packetID uint16, returnCodes []byte) []byte {
+func CreateSubAck(version byte, packetID uint16, returnCodes []byte, props *Properties) []byte {
 	var payload []byte
 
 	packetIDBuf := make([]byte, 2)
 	binary.BigEndian.PutUint16(packetIDBuf, packetID)
 	payload = append(payload, packetIDBuf...)
 
+	if version == Version5 {
+		payload = append(payload, encodeProperties(props)...)
+	}
+
 	payload = append(payload, returnCodes...)
 
 	return CreatePacket(SUBACK, payload)
 }
 
+// CreatePubAck 创建PUBACK包
+func CreatePubAck(version byte, packetID uint16, reasonCode byte, props *Properties) []byte {
+	return createAck(PUBACK<<4, version, packetID, reasonCode, props)
+}
+
+// CreatePubRec 创建PUBREC包
+func CreatePubRec(version byte, packetID uint16, reasonCode byte, props *Properties) []byte {
+	return createAck(PUBREC<<4, version, packetID, reasonCode, props)
+}
+
+// CreatePubRel 创建PUBREL包，固定头标志位为0010
+func CreatePubRel(version byte, packetID uint16, reasonCode byte, props *Properties) []byte {
+	return createAck(PUBREL<<4|0x02, version, packetID, reasonCode, props)
+}
+
+// CreatePubComp 创建PUBCOMP包
+func CreatePubComp(version byte, packetID uint16, reasonCode byte, props *Properties) []byte {
+	return createAck(PUBCOMP<<4, version, packetID, reasonCode, props)
+}
+
+// createAck 创建确认包，MQTT 5.0原因码为0且没有属性时省略原因码
+func createAck(fixedHeader byte, version byte, packetID uint16, reasonCode byte, props *Properties) []byte {
+	variableHeader := make([]byte, 2, 4)
+	binary.BigEndian.PutUint16(variableHeader, packetID)
+
+	if version == Version5 && (reasonCode != ReasonSuccess || props != nil) {
+		variableHeader = append(variableHeader, reasonCode)
+		if props != nil {
+			variableHeader = append(variableHeader, encodeProperties(props)...)
+		}
+	}
+
+	packet := []byte{fixedHeader}
+	packet = append(packet, encodeLength(len(variableHeader))...)
+	return append(packet, variableHeader...)
+}
+
+// CreateUnsubAck 创建UNSUBACK包，MQTT 5.0时携带属性及每个主题过滤器的原因码
+func CreateUnsubAck(version byte, packetID uint16, reasonCodes []byte, props *Properties) []byte {
+	payload := make([]byte, 2)
+	binary.BigEndian.PutUint16(payload, packetID)
+
+	if version == Version5 {
+		payload = append(payload, encodeProperties(props)...)
+		payload = append(payload, reasonCodes...)
+	}
+
+	return CreatePacket(UNSUBACK, payload)
+}
+
+// CreateAuth 创建AUTH包（MQTT 5.0）
+func CreateAuth(reasonCode byte, props *Properties) []byte {
+	payload := []byte{reasonCode}
+	payload = append(payload, encodeProperties(props)...)
+
+	return CreatePacket(AUTH, payload)
+}
+
+// CreateDisconnect 创建DISCONNECT包，原因码和属性仅用于MQTT 5.0
+func CreateDisconnect(version byte, reasonCode byte, props *Properties) []byte {
+	if version != Version5 {
+		return CreatePacket(DISCONNECT)
+	}
+
+	payload := []byte{reasonCode}
+	payload = append(payload, encodeProperties(props)...)
+
+	return CreatePacket(DISCONNECT, payload)
+}
+
+// CreatePublish 创建PUBLISH包，MQTT 5.0时携带属性
+func CreatePublish(version byte, p *PublishPacket) []byte {
+	fixedHeader := byte(PUBLISH<<4) | (p.QoS&0x03)<<1
+	if p.Dup {
+		fixedHeader |= 0x08
+	}
+	if p.Retain {
+		fixedHeader |= 0x01
+	}
+
+	variableHeader := EncodeBinary(p.TopicName)
+	if p.QoS > 0 {
+		packetIDBuf := make([]byte, 2)
+		binary.BigEndian.PutUint16(packetIDBuf, p.PacketID)
+		variableHeader = append(variableHeader, packetIDBuf...)
+	}
+	if version == Version5 {
+		variableHeader = append(variableHeader, encodeProperties(p.Properties)...)
+	}
+
+	encodedLength := encodeLength(len(variableHeader) + len(p.Payload))
+
+	packet := make([]byte, 0, 1+len(encodedLength)+len(variableHeader)+len(p.Payload))
+	packet = append(packet, fixedHeader)
+	packet = append(packet, encodedLength...)
+	packet = append(packet, variableHeader...)
+	packet = append(packet, p.Payload...)
+
+	return packet
+}
+
 // EncodeBinary 编码二进制数据（UTF-8字符串）
 func EncodeBinary(data []byte) []byte {
 	result := make([]byte, 2+len(data))
@@ -0,0 +1,92 @@
+package mqtt
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/panjf2000/gnet/v2"
+)
+
+// inboundConn 只实现MQTTCodec.Decode用到的方法的gnet.Conn
+type inboundConn struct {
+	gnet.Conn
+	inbound []byte
+}
+
+func (c *inboundConn) InboundBuffered() int {
+	return len(c.inbound)
+}
+
+func (c *inboundConn) Next(n int) ([]byte, error) {
+	if n < 0 || n > len(c.inbound) {
+		n = len(c.inbound)
+	}
+	buf := c.inbound[:n]
+	c.inbound = c.inbound[n:]
+	return buf, nil
+}
+
+func TestMQTTCodecDecodeDrainsCoalescedPackets(t *testing.T) {
+	packets := [][]byte{CreatePingResp(), publishPacket(300), publishPacket(20000), CreatePingResp()}
+	stream := bytes.Join(packets, nil)
+
+	// 最后一个报文只到达一部分
+	conn := &inboundConn{inbound: stream[:len(stream)-1]}
+	var codec MQTTCodec
+	for i, want := range packets[:3] {
+		got, err := codec.Decode(conn)
+		if err != nil {
+			t.Fatalf("packet %d: %v", i, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("packet %d: got %d bytes, want %d", i, len(got), len(want))
+		}
+	}
+	if got, err := codec.Decode(conn); got != nil || err != nil {
+		t.Fatalf("incomplete packet decoded as % x, %v", got, err)
+	}
+
+	conn.inbound = stream[len(stream)-1:]
+	got, err := codec.Decode(conn)
+	if err != nil || !bytes.Equal(got, packets[3]) {
+		t.Fatalf("completed packet = % x, %v", got, err)
+	}
+}
+
+func TestMQTTCodecDecodeSplitLength(t *testing.T) {
+	packet := publishPacket(20000)
+	var codec MQTTCodec
+
+	// 剩余长度字段被拆开时等待后续数据，而不是报错
+	conn := &inboundConn{inbound: packet[:2]}
+	if got, err := codec.Decode(conn); got != nil || err != nil {
+		t.Fatalf("partial header decoded as % x, %v", got, err)
+	}
+	conn.inbound = packet[2:]
+	got, err := codec.Decode(conn)
+	if err != nil || !bytes.Equal(got, packet) {
+		t.Fatalf("got %d bytes, %v", len(got), err)
+	}
+}
+
+func TestMQTTCodecDecodeRejectsOversizeBeforeBuffering(t *testing.T) {
+	large := publishPacket(20000)
+	small := publishPacket(300)
+	codec := NewMQTTCodec(1024)
+
+	// 只到达固定报头和部分内容时即返回错误，不等待整个报文
+	conn := &inboundConn{inbound: large[:100]}
+	got, err := codec.Decode(conn)
+	var tooLarge *PacketTooLargeError
+	if !errors.As(err, &tooLarge) || tooLarge.Size != len(large) {
+		t.Fatalf("oversize packet = %d bytes, %v", len(got), err)
+	}
+
+	// 超长报文的剩余部分被丢弃，之后的报文正常解码
+	conn.inbound = append(append([]byte{}, large[100:]...), small...)
+	got, err = codec.Decode(conn)
+	if err != nil || !bytes.Equal(got, small) {
+		t.Fatalf("packet after oversize = %d bytes, %v", len(got), err)
+	}
+}
@@ -12,6 +12,9 @@ const (
 	CONNACK     = 2
 	PUBLISH     = 3
 	PUBACK      = 4
+	PUBREC      = 5
+	PUBREL      = 6
+	PUBCOMP     = 7
 	SUBSCRIBE   = 8
 	SUBACK      = 9
 	UNSUBSCRIBE = 10
@@ -19,8 +22,12 @@ const (
 	PINGREQ     = 12
 	PINGRESP    = 13
 	DISCONNECT  = 14
+	AUTH        = 15 // MQTT 5.0
 )
 
+// SubAckFailure SUBACK订阅失败返回码
+const SubAckFailure = 0x80
+
 // 错误定义
 var (
 	ErrMalformedPacket = errors.New("malformed packet")
@@ -29,48 +36,100 @@ var (
 
 // ConnectPacket 连接报文
 type ConnectPacket struct {
-	ProtocolName  []byte
-	ProtocolLevel byte
-	CleanSession  bool
-	WillFlag      bool
-	WillQoS       byte
-	WillRetain    bool
-	UsernameFlag  bool
-	PasswordFlag  bool
-	KeepAlive     uint16
-	ClientID      []byte
-	WillTopic     []byte
-	WillMessage   []byte
-	Username      []byte
-	Password      []byte
+	ProtocolName   []byte
+	ProtocolLevel  byte
+	CleanSession   bool // MQTT 5.0中为Clean Start
+	WillFlag       bool
+	WillQoS        byte
+	WillRetain     bool
+	UsernameFlag   bool
+	PasswordFlag   bool
+	KeepAlive      uint16
+	Properties     *Properties
+	ClientID       []byte
+	WillProperties *Properties
+	WillTopic      []byte
+	WillMessage    []byte
+	Username       []byte
+	Password       []byte
 }
 
 // PublishPacket 发布报文
 type PublishPacket struct {
-	TopicName []byte
-	Payload   []byte
-	QoS       byte
-	PacketID  uint16
-	Retain    bool
-	Dup       bool
+	TopicName  []byte
+	Payload    []byte
+	QoS        byte
+	PacketID   uint16
+	Retain     bool
+	Dup        bool
+	Properties *Properties
+}
+
+// PubAckPacket 发布确认报文
+type PubAckPacket struct {
+	PacketID   uint16
+	ReasonCode byte
+	Properties *Properties
+}
+
+// PubRecPacket 发布收到报文（QoS 2第一步确认）
+type PubRecPacket struct {
+	PacketID   uint16
+	ReasonCode byte
+	Properties *Properties
+}
+
+// PubRelPacket 发布释放报文（QoS 2第二步）
+type PubRelPacket struct {
+	PacketID   uint16
+	ReasonCode byte
+	Properties *Properties
+}
+
+// PubCompPacket 发布完成报文（QoS 2第三步确认）
+type PubCompPacket struct {
+	PacketID   uint16
+	ReasonCode byte
+	Properties *Properties
 }
 
 // SubscribePacket 订阅报文
 type SubscribePacket struct {
-	PacketID uint16
-	Topics   []SubscribeTopic
+	PacketID   uint16
+	Properties *Properties
+	Topics     []SubscribeTopic
 }
 
+// SubscribeTopic 订阅的主题过滤器及订阅选项
 type SubscribeTopic struct {
-	TopicFilter []byte
-	QoS         byte
+	TopicFilter       []byte
+	QoS               byte
+	NoLocal           bool // MQTT 5.0 不接收自己发布的消息
+	RetainAsPublished bool // MQTT 5.0 转发时保留原消息的保留标志
+	RetainHandling    byte // MQTT 5.0 订阅时发送保留消息的方式
+}
+
+// UnsubscribePacket 取消订阅报文
+type UnsubscribePacket struct {
+	PacketID   uint16
+	Properties *Properties
+	Topics     [][]byte
 }
 
 // PingReqPacket 心跳请求
 type PingReqPacket struct{}
 
 // DisconnectPacket 断开连接
-type DisconnectPacket struct{}
+type DisconnectPacket struct {
+	ReasonCode byte
+	Properties *Properties
+}
+
+// AuthPacket 增强认证报文（MQTT 5.0）
+type AuthPacket struct {
+	ReasonCode byte
+	Properties *Properties
+}
 
 // packetReader 辅助读取器
 type packetReader struct {
@@ -140,8 +199,8 @@ func readLength(r *packetReader) (int, error) {
 	return value, nil
 }
 
-// DecodePacket 解析MQTT报文
-func DecodePacket(data []byte) (interface{}, error) {
+// DecodePacket 解析MQTT报文，version为连接协商的协议版本，CONNECT报文按其自身的协议级别解析
+func DecodePacket(data []byte, version byte) (interface{}, error) {
 	if len(data) < 2 {
 		return nil, ErrMalformedPacket
 	}
@@ -163,19 +222,52 @@ func DecodePacket(data []byte) (interface{}, error) {
 	if reader.remaining() < remainingLength {
 		return nil, ErrMalformedPacket
 	}
+	reader.buf = reader.buf[:reader.pos+remainingLength]
 
 	// 根据报文类型解析
 	switch packetType {
 	case CONNECT:
 		return decodeConnectPacket(reader, flags)
 	case PUBLISH:
-		return decodePublishPacket(reader, flags, remainingLength)
+		return decodePublishPacket(reader, flags, version)
+	case PUBACK:
+		packetID, reasonCode, props, err := decodeAck(reader, version)
+		if err != nil {
+			return nil, err
+		}
+		return &PubAckPacket{PacketID: packetID, ReasonCode: reasonCode, Properties: props}, nil
+	case PUBREC:
+		packetID, reasonCode, props, err := decodeAck(reader, version)
+		if err != nil {
+			return nil, err
+		}
+		return &PubRecPacket{PacketID: packetID, ReasonCode: reasonCode, Properties: props}, nil
+	case PUBREL:
+		// PUBREL固定头标志位必须为0010
+		if flags != 0x02 {
+			return nil, ErrMalformedPacket
+		}
+		packetID, reasonCode, props, err := decodeAck(reader, version)
+		if err != nil {
+			return nil, err
+		}
+		return &PubRelPacket{PacketID: packetID, ReasonCode: reasonCode, Properties: props}, nil
+	case PUBCOMP:
+		packetID, reasonCode, props, err := decodeAck(reader, version)
+		if err != nil {
+			return nil, err
+		}
+		return &PubCompPacket{PacketID: packetID, ReasonCode: reasonCode, Properties: props}, nil
 	case SUBSCRIBE:
-		return decodeSubscribePacket(reader, flags)
+		return decodeSubscribePacket(reader, flags, version)
+	case UNSUBSCRIBE:
+		return decodeUnsubscribePacket(reader, flags, version)
 	case PINGREQ:
 		return &PingReqPacket{}, nil
 	case DISCONNECT:
-		return &DisconnectPacket{}, nil
+		return decodeDisconnectPacket(reader, version)
+	case AUTH:
+		return decodeAuthPacket(reader, flags, version)
 	default:
 		return nil, fmt.Errorf("unsupported packet type: %d", packetType)
 	}
@@ -214,12 +306,26 @@ func decodeConnectPacket(r *packetReader, flags byte) (*ConnectPacket, error) {
 	keepAliveBuf := r.readBytes(2)
 	p.KeepAlive = binary.BigEndian.Uint16(keepAliveBuf)
 
+	if p.ProtocolLevel == Version5 {
+		p.Properties, err = readProperties(r)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	p.ClientID, err = readBinary(r)
 	if err != nil {
 		return nil, err
 	}
 
 	if p.WillFlag {
+		if p.ProtocolLevel == Version5 {
+			p.WillProperties, err = readProperties(r)
+			if err != nil {
+				return nil, err
+			}
+		}
+
 		p.WillTopic, err = readBinary(r)
 		if err != nil {
 			return nil, err
@@ -261,7 +367,7 @@ func decodeConnectPacket(r *packetReader, flags byte) (*ConnectPacket, error) {
 }
 
 // decodePublishPacket 解析PUBLISH报文
-func decodePublishPacket(r *packetReader, flags byte, remainingLength int) (*PublishPacket, error) {
+func decodePublishPacket(r *packetReader, flags byte, version byte) (*PublishPacket, error) {
 	p := &PublishPacket{}
 
 	// 解析标志位
@@ -285,17 +391,56 @@ func decodePublishPacket(r *packetReader, flags byte, remainingLength int) (*Pub
 		p.PacketID = binary.BigEndian.Uint16(packetIDBuf)
 	}
 
+	if version == Version5 {
+		p.Properties, err = readProperties(r)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	// 剩余的都是有效载荷
-	payloadLength := remainingLength - (r.pos - 1)
-	if payloadLength > 0 {
-		p.Payload = r.readBytes(payloadLength)
+	if r.remaining() > 0 {
+		p.Payload = r.readBytes(r.remaining())
 	}
 
 	return p, nil
 }
 
+// decodeAck 解析PUBACK/PUBREC/PUBREL/PUBCOMP报文
+// MQTT 5.0中剩余长度为2时原因码为0且没有属性
+func decodeAck(r *packetReader, version byte) (uint16, byte, *Properties, error) {
+	packetID, err := readPacketID(r)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	if version != Version5 || r.remaining() == 0 {
+		return packetID, ReasonSuccess, nil, nil
+	}
+
+	reasonCode := r.readByte()
+	if r.remaining() == 0 {
+		return packetID, reasonCode, nil, nil
+	}
+
+	props, err := readProperties(r)
+	if err != nil {
+		return 0, 0, nil, err
+	}
+	return packetID, reasonCode, props, nil
+}
+
+// readPacketID 读取报文标识符
+func readPacketID(r *packetReader) (uint16, error) {
+	if r.remaining() < 2 {
+		return 0, ErrMalformedPacket
+	}
+	packetIDBuf := r.readBytes(2)
+
+	return binary.BigEndian.Uint16(packetIDBuf), nil
+}
+
 // decodeSubscribePacket 解析SUBSCRIBE报文
-func decodeSubscribePacket(r *packetReader, flags byte) (*SubscribePacket, error) {
+func decodeSubscribePacket(r *packetReader, flags byte, version byte) (*SubscribePacket, error) {
 	p := &SubscribePacket{}
 
 	// 读取PacketID
@@ -305,6 +450,14 @@ func decodeSubscribePacket(r *packetReader, flags byte) (*SubscribePacket, error
 	packetIDBuf := r.readBytes(2)
 	p.PacketID = binary.BigEndian.Uint16(packetIDBuf)
 
+	if version == Version5 {
+		var err error
+		p.Properties, err = readProperties(r)
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	// 读取主题过滤器列表
 	for r.remaining() > 0 {
 		topicFilter, err := readBinary(r)
@@ -315,12 +468,113 @@ func decodeSubscribePacket(r *packetReader, flags byte) (*SubscribePacket, error
 		if r.remaining() < 1 {
 			return nil, ErrMalformedPacket
 		}
-		qos := r.readByte() & 0x03
+		topic, err := decodeSubscriptionOptions(r.readByte(), version)
+		if err != nil {
+			return nil, err
+		}
+		topic.TopicFilter = topicFilter
+
+		p.Topics = append(p.Topics, topic)
+	}
+
+	return p, nil
+}
+
+// decodeSubscriptionOptions 解析订阅选项字节，保留位必须为0
+func decodeSubscriptionOptions(options byte, version byte) (SubscribeTopic, error) {
+	reserved := byte(0xFC)
+	if version == Version5 {
+		reserved = 0xC0
+	}
+	if options&reserved != 0 {
+		return SubscribeTopic{}, ErrMalformedPacket
+	}
+
+	topic := SubscribeTopic{
+		QoS:               options & 0x03,
+		NoLocal:           options&0x04 != 0,
+		RetainAsPublished: options&0x08 != 0,
+		RetainHandling:    (options >> 4) & 0x03,
+	}
+	if topic.QoS > 2 || topic.RetainHandling > 2 {
+		return SubscribeTopic{}, ErrMalformedPacket
+	}
+	return topic, nil
+}
+
+// decodeUnsubscribePacket 解析UNSUBSCRIBE报文
+func decodeUnsubscribePacket(r *packetReader, flags byte, version byte) (*UnsubscribePacket, error) {
+	p := &UnsubscribePacket{}
+
+	// 读取PacketID
+	if r.remaining() < 2 {
+		return nil, ErrMalformedPacket
+	}
+	packetIDBuf := r.readBytes(2)
+	p.PacketID = binary.BigEndian.Uint16(packetIDBuf)
+
+	if version == Version5 {
+		var err error
+		p.Properties, err = readProperties(r)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// 读取主题过滤器列表
+	for r.remaining() > 0 {
+		topicFilter, err := readBinary(r)
+		if err != nil {
+			return nil, err
+		}
+		p.Topics = append(p.Topics, topicFilter)
+	}
+
+	// 至少需要包含一个主题过滤器
+	if len(p.Topics) == 0 {
+		return nil, ErrMalformedPacket
+	}
+
+	return p, nil
+}
+
+// decodeDisconnectPacket 解析DISCONNECT报文，MQTT 5.0中可携带原因码和属性
+func decodeDisconnectPacket(r *packetReader, version byte) (*DisconnectPacket, error) {
+	p := &DisconnectPacket{}
+	if version != Version5 || r.remaining() == 0 {
+		return p, nil
+	}
+
+	p.ReasonCode = r.readByte()
+	if r.remaining() > 0 {
+		var err error
+		p.Properties, err = readProperties(r)
+		if err != nil {
+			return nil, err
+		}
+	}
 
-		p.Topics = append(p.Topics, SubscribeTopic{
-			TopicFilter: topicFilter,
-			QoS:         qos,
-		})
+	return p, nil
+}
+
+// decodeAuthPacket 解析AUTH报文，剩余长度为0时表示认证成功
+func decodeAuthPacket(r *packetReader, flags byte, version byte) (*AuthPacket, error) {
+	if version != Version5 || flags != 0 {
+		return nil, ErrMalformedPacket
+	}
+
+	p := &AuthPacket{}
+	if r.remaining() == 0 {
+		return p, nil
+	}
+
+	p.ReasonCode = r.readByte()
+	if r.remaining() > 0 {
+		var err error
+		p.Properties, err = readProperties(r)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	return p, nil
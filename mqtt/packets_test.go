@@ -0,0 +1,138 @@
+package mqtt
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestDecodeAck(t *testing.T) {
+	reasonString := &Properties{ReasonString: []byte("no")}
+
+	tests := []struct {
+		name       string
+		data       []byte
+		version    byte
+		packetID   uint16
+		reasonCode byte
+		props      *Properties
+	}{
+		{"v5 length 2", []byte{0x00, 0x07}, Version5, 7, ReasonSuccess, nil},
+		{"v5 length 3", []byte{0x00, 0x07, ReasonNoMatchingSubscribers}, Version5, 7, ReasonNoMatchingSubscribers, nil},
+		{"v5 length 4", []byte{0x00, 0x07, ReasonQuotaExceeded, 0x00}, Version5, 7, ReasonQuotaExceeded, &Properties{}},
+		{"v5 with properties", append([]byte{0x00, 0x07, ReasonUnspecifiedError}, encodeProperties(reasonString)...),
+			Version5, 7, ReasonUnspecifiedError, reasonString},
+		{"v3.1.1", []byte{0x01, 0x00}, Version311, 256, ReasonSuccess, nil},
+	}
+	for _, tt := range tests {
+		for _, packetType := range []byte{PUBACK, PUBREC} {
+			data := append([]byte{packetType << 4}, encodeLength(len(tt.data))...)
+			data = append(data, tt.data...)
+			packet, err := DecodePacket(data, tt.version)
+			if err != nil {
+				t.Fatalf("%s type %d: %v", tt.name, packetType, err)
+			}
+
+			var packetID uint16
+			var reasonCode byte
+			var props *Properties
+			switch p := packet.(type) {
+			case *PubAckPacket:
+				packetID, reasonCode, props = p.PacketID, p.ReasonCode, p.Properties
+			case *PubRecPacket:
+				packetID, reasonCode, props = p.PacketID, p.ReasonCode, p.Properties
+			default:
+				t.Fatalf("%s type %d: decoded as %T", tt.name, packetType, packet)
+			}
+			if packetID != tt.packetID || reasonCode != tt.reasonCode || !reflect.DeepEqual(props, tt.props) {
+				t.Errorf("%s type %d: got id=%d reason=0x%02x props=%+v", tt.name, packetType, packetID, reasonCode, props)
+			}
+		}
+	}
+}
+
+func TestDecodeAckMalformed(t *testing.T) {
+	for _, data := range [][]byte{
+		{PUBACK << 4, 0x01, 0x00},                   // 报文标识符不完整
+		{PUBREC << 4, 0x04, 0x00, 0x01, 0x00, 0x05}, // 属性长度超出报文
+		{PUBREL << 4, 0x02, 0x00, 0x01},             // PUBREL标志位必须为0010
+	} {
+		if _, err := DecodePacket(data, Version5); !errors.Is(err, ErrMalformedPacket) {
+			t.Errorf("DecodePacket(% x) = %v, want ErrMalformedPacket", data, err)
+		}
+	}
+}
+
+func TestCreateAckShortForm(t *testing.T) {
+	// 原因码为0且没有属性时省略原因码，剩余长度为2
+	if got := CreatePubAck(Version5, 7, ReasonSuccess, nil); !bytes.Equal(got, []byte{PUBACK << 4, 0x02, 0x00, 0x07}) {
+		t.Fatalf("PUBACK = % x", got)
+	}
+	if got := CreatePubRec(Version5, 7, ReasonNoMatchingSubscribers, nil); !bytes.Equal(got, []byte{PUBREC << 4, 0x03, 0x00, 0x07, 0x10}) {
+		t.Fatalf("PUBREC = % x", got)
+	}
+	if got := CreatePubRel(Version311, 7, ReasonPacketIdentifierNotFound, nil); !bytes.Equal(got, []byte{PUBREL<<4 | 0x02, 0x02, 0x00, 0x07}) {
+		t.Fatalf("v3.1.1 PUBREL = % x", got)
+	}
+}
+
+func TestDecodeAuth(t *testing.T) {
+	props := &Properties{AuthenticationMethod: []byte("SCRAM-SHA-256"), AuthenticationData: []byte("data")}
+
+	tests := []struct {
+		name       string
+		data       []byte
+		reasonCode byte
+		props      *Properties
+	}{
+		{"length 0", []byte{AUTH << 4, 0x00}, ReasonSuccess, nil},
+		{"length 1", []byte{AUTH << 4, 0x01, ReasonReAuthenticate}, ReasonReAuthenticate, nil},
+		{"with properties", CreateAuth(ReasonContinueAuthentication, props), ReasonContinueAuthentication, props},
+	}
+	for _, tt := range tests {
+		packet, err := DecodePacket(tt.data, Version5)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		p := packet.(*AuthPacket)
+		if p.ReasonCode != tt.reasonCode || !reflect.DeepEqual(p.Properties, tt.props) {
+			t.Errorf("%s: got reason=0x%02x props=%+v", tt.name, p.ReasonCode, p.Properties)
+		}
+	}
+
+	// AUTH只用于MQTT 5.0，固定头标志位必须为0
+	if _, err := DecodePacket([]byte{AUTH << 4, 0x00}, Version311); !errors.Is(err, ErrMalformedPacket) {
+		t.Errorf("v3.1.1 AUTH: %v", err)
+	}
+	if _, err := DecodePacket([]byte{AUTH<<4 | 0x01, 0x00}, Version5); !errors.Is(err, ErrMalformedPacket) {
+		t.Errorf("AUTH with flags: %v", err)
+	}
+}
+
+func TestDecodeDisconnect(t *testing.T) {
+	props := &Properties{SessionExpiryInterval: Uint32(0), ReasonString: []byte("bye")}
+
+	tests := []struct {
+		name       string
+		data       []byte
+		version    byte
+		reasonCode byte
+		props      *Properties
+	}{
+		{"v5 length 0", []byte{DISCONNECT << 4, 0x00}, Version5, ReasonNormalDisconnection, nil},
+		{"v5 length 1", []byte{DISCONNECT << 4, 0x01, ReasonDisconnectWithWill}, Version5, ReasonDisconnectWithWill, nil},
+		{"v5 with properties", CreateDisconnect(Version5, ReasonServerShuttingDown, props), Version5, ReasonServerShuttingDown, props},
+		{"v3.1.1", CreateDisconnect(Version311, ReasonServerShuttingDown, props), Version311, ReasonNormalDisconnection, nil},
+	}
+	for _, tt := range tests {
+		packet, err := DecodePacket(tt.data, tt.version)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		p := packet.(*DisconnectPacket)
+		if p.ReasonCode != tt.reasonCode || !reflect.DeepEqual(p.Properties, tt.props) {
+			t.Errorf("%s: got reason=0x%02x props=%+v", tt.name, p.ReasonCode, p.Properties)
+		}
+	}
+}
@@ -0,0 +1,284 @@
+package mqtt
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// 属性标识符（MQTT 5.0）
+const (
+	PropPayloadFormatIndicator          = 0x01
+	PropMessageExpiryInterval           = 0x02
+	PropContentType                     = 0x03
+	PropResponseTopic                   = 0x08
+	PropCorrelationData                 = 0x09
+	PropSubscriptionIdentifier          = 0x0B
+	PropSessionExpiryInterval           = 0x11
+	PropAssignedClientIdentifier        = 0x12
+	PropServerKeepAlive                 = 0x13
+	PropAuthenticationMethod            = 0x15
+	PropAuthenticationData              = 0x16
+	PropRequestProblemInformation       = 0x17
+	PropWillDelayInterval               = 0x18
+	PropRequestResponseInformation      = 0x19
+	PropResponseInformation             = 0x1A
+	PropServerReference                 = 0x1C
+	PropReasonString                    = 0x1F
+	PropReceiveMaximum                  = 0x21
+	PropTopicAliasMaximum               = 0x22
+	PropTopicAlias                      = 0x23
+	PropMaximumQoS                      = 0x24
+	PropRetainAvailable                 = 0x25
+	PropUserProperty                    = 0x26
+	PropMaximumPacketSize               = 0x27
+	PropWildcardSubscriptionAvailable   = 0x28
+	PropSubscriptionIdentifierAvailable = 0x29
+	PropSharedSubscriptionAvailable     = 0x2A
+)
+
+// ErrProtocolError 协议错误，如重复的属性
+var ErrProtocolError = errors.New("protocol error")
+
+// UserProperty 用户属性键值对
+type UserProperty struct {
+	Key   []byte
+	Value []byte
+}
+
+// Properties MQTT 5.0 属性，指针和切片为nil表示属性不存在
+type Properties struct {
+	PayloadFormatIndicator          *byte
+	MessageExpiryInterval           *uint32
+	ContentType                     []byte
+	ResponseTopic                   []byte
+	CorrelationData                 []byte
+	SubscriptionIdentifiers         []uint32
+	SessionExpiryInterval           *uint32
+	AssignedClientIdentifier        []byte
+	ServerKeepAlive                 *uint16
+	AuthenticationMethod            []byte
+	AuthenticationData              []byte
+	RequestProblemInformation       *byte
+	WillDelayInterval               *uint32
+	RequestResponseInformation      *byte
+	ResponseInformation             []byte
+	ServerReference                 []byte
+	ReasonString                    []byte
+	ReceiveMaximum                  *uint16
+	TopicAliasMaximum               *uint16
+	TopicAlias                      *uint16
+	MaximumQoS                      *byte
+	RetainAvailable                 *byte
+	UserProperties                  []UserProperty
+	MaximumPacketSize               *uint32
+	WildcardSubscriptionAvailable   *byte
+	SubscriptionIdentifierAvailable *byte
+	SharedSubscriptionAvailable     *byte
+}
+
+// Byte 返回指向字节值的指针，用于设置属性
+func Byte(v byte) *byte { return &v }
+
+// Uint16 返回指向uint16值的指针，用于设置属性
+func Uint16(v uint16) *uint16 { return &v }
+
+// Uint32 返回指向uint32值的指针，用于设置属性
+func Uint32(v uint32) *uint32 { return &v }
+
+// readProperties 读取属性长度及属性列表
+func readProperties(r *packetReader) (*Properties, error) {
+	length, err := readLength(r)
+	if err != nil {
+		return nil, err
+	}
+	if r.remaining() < length {
+		return nil, ErrMalformedPacket
+	}
+
+	p := &Properties{}
+	pr := &packetReader{buf: r.readBytes(length)}
+	seen := make(map[byte]bool)
+
+	for pr.remaining() > 0 {
+		id := pr.readByte()
+
+		// 除用户属性和订阅标识符外，属性不能重复出现
+		if id != PropUserProperty && id != PropSubscriptionIdentifier {
+			if seen[id] {
+				return nil, ErrProtocolError
+			}
+			seen[id] = true
+		}
+
+		switch id {
+		case PropPayloadFormatIndicator:
+			p.PayloadFormatIndicator, err = readByteProp(pr)
+		case PropRequestProblemInformation:
+			p.RequestProblemInformation, err = readByteProp(pr)
+		case PropRequestResponseInformation:
+			p.RequestResponseInformation, err = readByteProp(pr)
+		case PropMaximumQoS:
+			p.MaximumQoS, err = readByteProp(pr)
+		case PropRetainAvailable:
+			p.RetainAvailable, err = readByteProp(pr)
+		case PropWildcardSubscriptionAvailable:
+			p.WildcardSubscriptionAvailable, err = readByteProp(pr)
+		case PropSubscriptionIdentifierAvailable:
+			p.SubscriptionIdentifierAvailable, err = readByteProp(pr)
+		case PropSharedSubscriptionAvailable:
+			p.SharedSubscriptionAvailable, err = readByteProp(pr)
+		case PropServerKeepAlive:
+			p.ServerKeepAlive, err = readUint16Prop(pr)
+		case PropReceiveMaximum:
+			p.ReceiveMaximum, err = readUint16Prop(pr)
+		case PropTopicAliasMaximum:
+			p.TopicAliasMaximum, err = readUint16Prop(pr)
+		case PropTopicAlias:
+			p.TopicAlias, err = readUint16Prop(pr)
+		case PropMessageExpiryInterval:
+			p.MessageExpiryInterval, err = readUint32Prop(pr)
+		case PropSessionExpiryInterval:
+			p.SessionExpiryInterval, err = readUint32Prop(pr)
+		case PropWillDelayInterval:
+			p.WillDelayInterval, err = readUint32Prop(pr)
+		case PropMaximumPacketSize:
+			p.MaximumPacketSize, err = readUint32Prop(pr)
+		case PropContentType:
+			p.ContentType, err = readBinary(pr)
+		case PropResponseTopic:
+			p.ResponseTopic, err = readBinary(pr)
+		case PropCorrelationData:
+			p.CorrelationData, err = readBinary(pr)
+		case PropAssignedClientIdentifier:
+			p.AssignedClientIdentifier, err = readBinary(pr)
+		case PropAuthenticationMethod:
+			p.AuthenticationMethod, err = readBinary(pr)
+		case PropAuthenticationData:
+			p.AuthenticationData, err = readBinary(pr)
+		case PropResponseInformation:
+			p.ResponseInformation, err = readBinary(pr)
+		case PropServerReference:
+			p.ServerReference, err = readBinary(pr)
+		case PropReasonString:
+			p.ReasonString, err = readBinary(pr)
+		case PropSubscriptionIdentifier:
+			var id int
+			id, err = readLength(pr)
+			if err == nil && id == 0 {
+				err = ErrProtocolError
+			}
+			p.SubscriptionIdentifiers = append(p.SubscriptionIdentifiers, uint32(id))
+		case PropUserProperty:
+			var up UserProperty
+			up.Key, err = readBinary(pr)
+			if err == nil {
+				up.Value, err = readBinary(pr)
+			}
+			p.UserProperties = append(p.UserProperties, up)
+		default:
+			return nil, ErrMalformedPacket
+		}
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return p, nil
+}
+
+func readByteProp(r *packetReader) (*byte, error) {
+	if r.remaining() < 1 {
+		return nil, ErrMalformedPacket
+	}
+	v := r.readByte()
+	return &v, nil
+}
+
+func readUint16Prop(r *packetReader) (*uint16, error) {
+	if r.remaining() < 2 {
+		return nil, ErrMalformedPacket
+	}
+	v := binary.BigEndian.Uint16(r.readBytes(2))
+	return &v, nil
+}
+
+func readUint32Prop(r *packetReader) (*uint32, error) {
+	if r.remaining() < 4 {
+		return nil, ErrMalformedPacket
+	}
+	v := binary.BigEndian.Uint32(r.readBytes(4))
+	return &v, nil
+}
+
+// encodeProperties 编码属性长度及属性列表，p为nil时编码为空属性
+func encodeProperties(p *Properties) []byte {
+	var buf []byte
+	if p != nil {
+		buf = p.appendTo(buf)
+	}
+	return append(encodeLength(len(buf)), buf...)
+}
+
+func (p *Properties) appendTo(buf []byte) []byte {
+	appendByte := func(id byte, v *byte) {
+		if v != nil {
+			buf = append(buf, id, *v)
+		}
+	}
+	appendUint16 := func(id byte, v *uint16) {
+		if v != nil {
+			buf = append(buf, id)
+			buf = binary.BigEndian.AppendUint16(buf, *v)
+		}
+	}
+	appendUint32 := func(id byte, v *uint32) {
+		if v != nil {
+			buf = append(buf, id)
+			buf = binary.BigEndian.AppendUint32(buf, *v)
+		}
+	}
+	appendBinary := func(id byte, v []byte) {
+		if v != nil {
+			buf = append(buf, id)
+			buf = append(buf, EncodeBinary(v)...)
+		}
+	}
+
+	appendByte(PropPayloadFormatIndicator, p.PayloadFormatIndicator)
+	appendUint32(PropMessageExpiryInterval, p.MessageExpiryInterval)
+	appendBinary(PropContentType, p.ContentType)
+	appendBinary(PropResponseTopic, p.ResponseTopic)
+	appendBinary(PropCorrelationData, p.CorrelationData)
+	for _, id := range p.SubscriptionIdentifiers {
+		buf = append(buf, PropSubscriptionIdentifier)
+		buf = append(buf, encodeLength(int(id))...)
+	}
+	appendUint32(PropSessionExpiryInterval, p.SessionExpiryInterval)
+	appendBinary(PropAssignedClientIdentifier, p.AssignedClientIdentifier)
+	appendUint16(PropServerKeepAlive, p.ServerKeepAlive)
+	appendBinary(PropAuthenticationMethod, p.AuthenticationMethod)
+	appendBinary(PropAuthenticationData, p.AuthenticationData)
+	appendByte(PropRequestProblemInformation, p.RequestProblemInformation)
+	appendUint32(PropWillDelayInterval, p.WillDelayInterval)
+	appendByte(PropRequestResponseInformation, p.RequestResponseInformation)
+	appendBinary(PropResponseInformation, p.ResponseInformation)
+	appendBinary(PropServerReference, p.ServerReference)
+	appendBinary(PropReasonString, p.ReasonString)
+	appendUint16(PropReceiveMaximum, p.ReceiveMaximum)
+	appendUint16(PropTopicAliasMaximum, p.TopicAliasMaximum)
+	appendUint16(PropTopicAlias, p.TopicAlias)
+	appendByte(PropMaximumQoS, p.MaximumQoS)
+	appendByte(PropRetainAvailable, p.RetainAvailable)
+	for _, up := range p.UserProperties {
+		buf = append(buf, PropUserProperty)
+		buf = append(buf, EncodeBinary(up.Key)...)
+		buf = append(buf, EncodeBinary(up.Value)...)
+	}
+	appendUint32(PropMaximumPacketSize, p.MaximumPacketSize)
+	appendByte(PropWildcardSubscriptionAvailable, p.WildcardSubscriptionAvailable)
+	appendByte(PropSubscriptionIdentifierAvailable, p.SubscriptionIdentifierAvailable)
+	appendByte(PropSharedSubscriptionAvailable, p.SharedSubscriptionAvailable)
+
+	return buf
+}
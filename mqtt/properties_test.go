@@ -0,0 +1,125 @@
+package mqtt
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// propertyBlock 在属性列表前加上属性长度
+func propertyBlock(raw ...byte) []byte {
+	return append(encodeLength(len(raw)), raw...)
+}
+
+func TestPropertiesRoundTrip(t *testing.T) {
+	tests := []struct {
+		name  string
+		props *Properties
+	}{
+		{"PayloadFormatIndicator", &Properties{PayloadFormatIndicator: Byte(1)}},
+		{"MessageExpiryInterval", &Properties{MessageExpiryInterval: Uint32(3600)}},
+		{"ContentType", &Properties{ContentType: []byte("application/json")}},
+		{"ResponseTopic", &Properties{ResponseTopic: []byte("resp/dev1/x")}},
+		{"CorrelationData", &Properties{CorrelationData: []byte{0x00, 0xff, 0x10}}},
+		{"SubscriptionIdentifier", &Properties{SubscriptionIdentifiers: []uint32{1}}},
+		{"SubscriptionIdentifiers", &Properties{SubscriptionIdentifiers: []uint32{127, 128, 16383, 268435455}}},
+		{"SessionExpiryInterval", &Properties{SessionExpiryInterval: Uint32(0xFFFFFFFF)}},
+		{"AssignedClientIdentifier", &Properties{AssignedClientIdentifier: []byte("auto-1")}},
+		{"ServerKeepAlive", &Properties{ServerKeepAlive: Uint16(30)}},
+		{"AuthenticationMethod", &Properties{AuthenticationMethod: []byte("SCRAM-SHA-256")}},
+		{"AuthenticationData", &Properties{AuthenticationData: []byte("n,,n=user,r=abc")}},
+		{"RequestProblemInformation", &Properties{RequestProblemInformation: Byte(0)}},
+		{"WillDelayInterval", &Properties{WillDelayInterval: Uint32(10)}},
+		{"RequestResponseInformation", &Properties{RequestResponseInformation: Byte(1)}},
+		{"ResponseInformation", &Properties{ResponseInformation: []byte("resp/dev1/")}},
+		{"ServerReference", &Properties{ServerReference: []byte("other:1883")}},
+		{"ReasonString", &Properties{ReasonString: []byte("bye")}},
+		{"ReceiveMaximum", &Properties{ReceiveMaximum: Uint16(10)}},
+		{"TopicAliasMaximum", &Properties{TopicAliasMaximum: Uint16(16)}},
+		{"TopicAlias", &Properties{TopicAlias: Uint16(3)}},
+		{"MaximumQoS", &Properties{MaximumQoS: Byte(1)}},
+		{"RetainAvailable", &Properties{RetainAvailable: Byte(0)}},
+		{"UserProperties", &Properties{UserProperties: []UserProperty{
+			{Key: []byte("a"), Value: []byte("1")},
+			{Key: []byte("a"), Value: []byte("2")},
+		}}},
+		{"MaximumPacketSize", &Properties{MaximumPacketSize: Uint32(1 << 20)}},
+		{"WildcardSubscriptionAvailable", &Properties{WildcardSubscriptionAvailable: Byte(1)}},
+		{"SubscriptionIdentifierAvailable", &Properties{SubscriptionIdentifierAvailable: Byte(1)}},
+		{"SharedSubscriptionAvailable", &Properties{SharedSubscriptionAvailable: Byte(0)}},
+		{"Empty binary", &Properties{ContentType: []byte{}}},
+		{"Combined", &Properties{
+			PayloadFormatIndicator: Byte(1),
+			MessageExpiryInterval:  Uint32(60),
+			ResponseTopic:          []byte("a/b"),
+			CorrelationData:        []byte("id"),
+			TopicAlias:             Uint16(1),
+			UserProperties:         []UserProperty{{Key: []byte("k"), Value: []byte("v")}},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encoded := encodeProperties(tt.props)
+			got, err := readProperties(&packetReader{buf: encoded})
+			if err != nil {
+				t.Fatalf("readProperties(% x): %v", encoded, err)
+			}
+			if !reflect.DeepEqual(got, tt.props) {
+				t.Fatalf("round trip = %+v, want %+v", got, tt.props)
+			}
+		})
+	}
+}
+
+func TestEncodePropertiesNil(t *testing.T) {
+	encoded := encodeProperties(nil)
+	if len(encoded) != 1 || encoded[0] != 0 {
+		t.Fatalf("encodeProperties(nil) = % x", encoded)
+	}
+	got, err := readProperties(&packetReader{buf: encoded})
+	if err != nil || !reflect.DeepEqual(got, &Properties{}) {
+		t.Fatalf("empty properties = %+v, %v", got, err)
+	}
+}
+
+func TestReadPropertiesErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		raw  []byte
+		err  error
+	}{
+		{"duplicate byte", propertyBlock(PropPayloadFormatIndicator, 1, PropPayloadFormatIndicator, 0), ErrProtocolError},
+		{"duplicate uint16", propertyBlock(PropTopicAlias, 0, 1, PropTopicAlias, 0, 2), ErrProtocolError},
+		{"duplicate uint32", propertyBlock(PropMessageExpiryInterval, 0, 0, 0, 1, PropMessageExpiryInterval, 0, 0, 0, 2), ErrProtocolError},
+		{"duplicate binary", propertyBlock(PropResponseTopic, 0, 1, 'a', PropResponseTopic, 0, 1, 'b'), ErrProtocolError},
+		{"zero subscription identifier", propertyBlock(PropSubscriptionIdentifier, 0), ErrProtocolError},
+		{"unknown property", propertyBlock(0x7F, 0), ErrMalformedPacket},
+		{"truncated uint32", propertyBlock(PropSessionExpiryInterval, 0, 0), ErrMalformedPacket},
+		{"truncated binary", propertyBlock(PropContentType, 0, 5, 'a'), ErrMalformedPacket},
+		{"length exceeds packet", []byte{5, PropPayloadFormatIndicator, 1}, ErrMalformedPacket},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := readProperties(&packetReader{buf: tt.raw}); !errors.Is(err, tt.err) {
+				t.Fatalf("readProperties(% x) = %v, want %v", tt.raw, err, tt.err)
+			}
+		})
+	}
+}
+
+func TestReadPropertiesRepeatable(t *testing.T) {
+	// 用户属性和订阅标识符可以出现多次
+	raw := propertyBlock(
+		PropUserProperty, 0, 1, 'k', 0, 1, '1',
+		PropUserProperty, 0, 1, 'k', 0, 1, '2',
+		PropSubscriptionIdentifier, 1,
+		PropSubscriptionIdentifier, 0x80, 0x01,
+	)
+	got, err := readProperties(&packetReader{buf: raw})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.UserProperties) != 2 || !reflect.DeepEqual(got.SubscriptionIdentifiers, []uint32{1, 128}) {
+		t.Fatalf("got %+v", got)
+	}
+}
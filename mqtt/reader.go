@@ -0,0 +1,63 @@
+package mqtt
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+)
+
+// maxFixedHeaderLength 固定报头的最大长度：1字节类型和标志，最多4字节剩余长度
+const maxFixedHeaderLength = 5
+
+// PacketTooLargeError 报文长度超过读取器的上限，报文内容已被丢弃
+type PacketTooLargeError struct {
+	Size int
+}
+
+func (e *PacketTooLargeError) Error() string {
+	return fmt.Sprintf("packet too large: %d bytes", e.Size)
+}
+
+// PacketReader 从字节流中读取完整的MQTT报文，处理拆包和粘包
+type PacketReader struct {
+	reader  *bufio.Reader
+	maxSize int
+}
+
+// NewPacketReader 创建报文读取器，maxSize为报文的最大长度，0表示不限制
+func NewPacketReader(r io.Reader, maxSize int) *PacketReader {
+	return &PacketReader{reader: bufio.NewReader(r), maxSize: maxSize}
+}
+
+// ReadPacket 读取下一个完整的MQTT报文（包含固定报头），阻塞直到报文完整或读取出错
+// 超过最大长度的报文在分配内存前被丢弃，返回*PacketTooLargeError，之后可以继续读取
+func (pr *PacketReader) ReadPacket() ([]byte, error) {
+	// 逐字节扩大窗口，直到剩余长度字段完整
+	totalLength := 0
+	for n := 2; totalLength == 0; n++ {
+		if n > maxFixedHeaderLength {
+			return nil, ErrInvalidLength
+		}
+		header, err := pr.reader.Peek(n)
+		if err != nil {
+			return nil, err
+		}
+		totalLength, err = parsePacketLength(header)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if pr.maxSize > 0 && totalLength > pr.maxSize {
+		if _, err := io.CopyN(io.Discard, pr.reader, int64(totalLength)); err != nil {
+			return nil, err
+		}
+		return nil, &PacketTooLargeError{Size: totalLength}
+	}
+
+	packet := make([]byte, totalLength)
+	if _, err := io.ReadFull(pr.reader, packet); err != nil {
+		return nil, err
+	}
+	return packet, nil
+}
@@ -0,0 +1,72 @@
+package mqtt
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+)
+
+func publishPacket(payloadSize int) []byte {
+	body := append([]byte{0x00, 0x01, 't'}, bytes.Repeat([]byte{'x'}, payloadSize)...)
+	return CreatePacket(PUBLISH, body)
+}
+
+func TestPacketReaderPipelined(t *testing.T) {
+	packets := [][]byte{CreatePingResp(), publishPacket(5000), publishPacket(10)}
+	r := NewPacketReader(bytes.NewReader(bytes.Join(packets, nil)), 0)
+
+	for i, want := range packets {
+		got, err := r.ReadPacket()
+		if err != nil {
+			t.Fatalf("packet %d: %v", i, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Fatalf("packet %d: got %d bytes, want %d", i, len(got), len(want))
+		}
+	}
+	if _, err := r.ReadPacket(); err != io.EOF {
+		t.Fatalf("after last packet: err = %v, want io.EOF", err)
+	}
+}
+
+func TestPacketReaderFourByteLength(t *testing.T) {
+	// 剩余长度2,097,152需要4字节编码：80 80 80 01
+	packet := publishPacket(2097152 - 3)
+	if !bytes.Equal(packet[:5], []byte{0x30, 0x80, 0x80, 0x80, 0x01}) {
+		t.Fatalf("unexpected header % x", packet[:5])
+	}
+
+	got, err := NewPacketReader(bytes.NewReader(packet), 0).ReadPacket()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(packet) {
+		t.Fatalf("got %d bytes, want %d", len(got), len(packet))
+	}
+}
+
+func TestPacketReaderInvalidLength(t *testing.T) {
+	data := []byte{0x30, 0x80, 0x80, 0x80, 0x80, 0x01}
+	if _, err := NewPacketReader(bytes.NewReader(data), 0).ReadPacket(); !errors.Is(err, ErrInvalidLength) {
+		t.Fatalf("err = %v, want ErrInvalidLength", err)
+	}
+}
+
+func TestPacketReaderTooLarge(t *testing.T) {
+	large := publishPacket(1000)
+	next := CreatePingResp()
+	r := NewPacketReader(bytes.NewReader(append(large, next...)), 100)
+
+	_, err := r.ReadPacket()
+	var tooLarge *PacketTooLargeError
+	if !errors.As(err, &tooLarge) || tooLarge.Size != len(large) {
+		t.Fatalf("err = %v, want PacketTooLargeError{%d}", err, len(large))
+	}
+
+	// 超长报文被丢弃后可以继续读取
+	got, err := r.ReadPacket()
+	if err != nil || !bytes.Equal(got, next) {
+		t.Fatalf("next packet = % x, %v", got, err)
+	}
+}
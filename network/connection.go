@@ -1,8 +1,14 @@
 package network
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"log/slog"
 	"net"
 
+	"busy-cloud/gnet-mqtt/mqtt"
 	"busy-cloud/gnet-mqtt/types"
 )
 
@@ -31,9 +37,57 @@ func (t *TCPConn) RemoteAddr() net.Addr {
 	return t.conn.RemoteAddr()
 }
 
+// PeerCertificates TLS连接上客户端提供的证书，握手完成前或非TLS连接返回nil
+func (t *TCPConn) PeerCertificates() []*x509.Certificate {
+	if tlsConn, ok := t.conn.(*tls.Conn); ok {
+		return tlsConn.ConnectionState().PeerCertificates
+	}
+	return nil
+}
+
 // ConnHandler 连接处理器接口
 type ConnHandler interface {
 	OnOpen(conn types.Conn)
 	OnMessage(conn types.Conn, data []byte)
 	OnClose(conn types.Conn, err error)
+	// MaxPacketSize 接收报文的最大长度，0表示不限制
+	MaxPacketSize() int
+	// OnPacketTooLarge 收到超过MaxPacketSize的报文，报文内容已被丢弃
+	OnPacketTooLarge(conn types.Conn, size int)
+}
+
+// serveConn 在当前goroutine中读取连接数据并交给处理器，连接关闭或ctx取消时返回
+func serveConn(ctx context.Context, conn net.Conn, handler ConnHandler, logger *slog.Logger) {
+	defer conn.Close()
+
+	logger.Debug("New TCP connection", "remote_addr", conn.RemoteAddr().String())
+
+	// 包装为标准连接
+	tcpConn := NewTCPConn(conn)
+
+	// 通知处理器有新连接
+	handler.OnOpen(tcpConn)
+
+	// 读取循环，每次交给处理器一个完整的MQTT报文
+	reader := mqtt.NewPacketReader(conn, handler.MaxPacketSize())
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+			packet, err := reader.ReadPacket()
+			var tooLarge *mqtt.PacketTooLargeError
+			if errors.As(err, &tooLarge) {
+				// 由处理器断开连接，继续读取直到连接关闭，保证断开原因能够发出
+				handler.OnPacketTooLarge(tcpConn, tooLarge.Size)
+				continue
+			}
+			if err != nil {
+				handler.OnClose(tcpConn, err)
+				return
+			}
+
+			handler.OnMessage(tcpConn, packet)
+		}
+	}
 }
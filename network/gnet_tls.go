@@ -0,0 +1,209 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/panjf2000/gnet/v2"
+)
+
+// maxPipeBuffered 每个连接等待解密的数据上限，超过时说明读取跟不上接收，断开连接
+const maxPipeBuffered = 4 << 20
+
+// GNetTLSServer 基于gnet的TLS服务器
+// gnet事件循环只负责收发密文，TLS握手、解密和报文读取在每个连接自己的goroutine中完成，不阻塞事件循环
+type GNetTLSServer struct {
+	gnet.BuiltinEventEngine
+
+	address   string
+	tlsConfig *tls.Config
+	handler   ConnHandler
+	eng       gnet.Engine
+	wg        sync.WaitGroup
+	ctx       context.Context
+	cancel    context.CancelFunc
+	logger    *slog.Logger
+}
+
+// NewGNetTLSServer 创建新的gnet TLS服务器
+func NewGNetTLSServer(address string, tlsConfig *tls.Config, handler ConnHandler, logger *slog.Logger) *GNetTLSServer {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return &GNetTLSServer{
+		address:   address,
+		tlsConfig: tlsConfig,
+		handler:   handler,
+		logger:    logger,
+	}
+}
+
+// Start 启动gnet TLS服务器
+func (s *GNetTLSServer) Start(ctx context.Context) error {
+	s.ctx, s.cancel = context.WithCancel(ctx)
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		err := gnet.Run(s, "tcp://"+s.address,
+			gnet.WithMulticore(true),
+			gnet.WithReusePort(true),
+			gnet.WithTCPNoDelay(gnet.TCPNoDelay),
+		)
+		if err != nil {
+			s.logger.Error("Gnet TLS server failed", "error", err)
+		}
+	}()
+
+	return nil
+}
+
+// Stop 停止gnet TLS服务器
+func (s *GNetTLSServer) Stop() error {
+	if s.cancel != nil {
+		s.cancel()
+	}
+	if err := s.eng.Stop(context.Background()); err != nil {
+		return fmt.Errorf("failed to stop gnet TLS server: %w", err)
+	}
+	s.wg.Wait()
+	s.logger.Info("Gnet TLS server stopped")
+	return nil
+}
+
+func (s *GNetTLSServer) OnBoot(eng gnet.Engine) (action gnet.Action) {
+	s.eng = eng
+	s.logger.Info("Gnet TLS server started", "address", s.address)
+	return gnet.None
+}
+
+func (s *GNetTLSServer) OnOpen(c gnet.Conn) (out []byte, action gnet.Action) {
+	pipe := newGNetPipe(c)
+	c.SetContext(pipe)
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		serveConn(s.ctx, tls.Server(pipe, s.tlsConfig), s.handler, s.logger)
+	}()
+	return nil, gnet.None
+}
+
+func (s *GNetTLSServer) OnTraffic(c gnet.Conn) (action gnet.Action) {
+	pipe, ok := c.Context().(*gnetPipe)
+	if !ok {
+		return gnet.Close
+	}
+	data, _ := c.Next(-1)
+	if !pipe.feed(data) {
+		s.logger.Warn("TLS input buffer full, closing connection",
+			"remote_addr", pipe.RemoteAddr().String())
+		return gnet.Close
+	}
+	return gnet.None
+}
+
+func (s *GNetTLSServer) OnClose(c gnet.Conn, err error) (action gnet.Action) {
+	if pipe, ok := c.Context().(*gnetPipe); ok {
+		pipe.closeInput()
+	}
+	return gnet.None
+}
+
+// gnetPipe 将gnet连接适配为net.Conn，供crypto/tls使用
+// 读取的数据由事件循环在OnTraffic中写入，写入通过AsyncWrite交给事件循环发送
+// gnet在连接关闭后会清空地址，因此在创建时保存
+type gnetPipe struct {
+	conn       gnet.Conn
+	localAddr  net.Addr
+	remoteAddr net.Addr
+	mu         sync.Mutex
+	cond       *sync.Cond
+	buffer     bytes.Buffer
+	eof        bool
+}
+
+func newGNetPipe(conn gnet.Conn) *gnetPipe {
+	p := &gnetPipe{
+		conn:       conn,
+		localAddr:  conn.LocalAddr(),
+		remoteAddr: conn.RemoteAddr(),
+	}
+	p.cond = sync.NewCond(&p.mu)
+	return p
+}
+
+// feed 写入从网络收到的数据，在事件循环中调用，缓冲超过maxPipeBuffered时返回false
+func (p *gnetPipe) feed(data []byte) bool {
+	p.mu.Lock()
+	if p.buffer.Len()+len(data) > maxPipeBuffered {
+		p.mu.Unlock()
+		return false
+	}
+	p.buffer.Write(data)
+	p.mu.Unlock()
+	p.cond.Signal()
+	return true
+}
+
+// closeInput gnet连接关闭后读取返回io.EOF
+func (p *gnetPipe) closeInput() {
+	p.mu.Lock()
+	p.eof = true
+	p.mu.Unlock()
+	p.cond.Broadcast()
+}
+
+func (p *gnetPipe) Read(b []byte) (n int, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for p.buffer.Len() == 0 {
+		if p.eof {
+			return 0, io.EOF
+		}
+		p.cond.Wait()
+	}
+	return p.buffer.Read(b)
+}
+
+func (p *gnetPipe) Write(b []byte) (n int, err error) {
+	// crypto/tls会复用写缓冲区，异步发送前需要复制
+	data := make([]byte, len(b))
+	copy(data, b)
+	if err := p.conn.AsyncWrite(data, nil); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (p *gnetPipe) Close() error {
+	return p.conn.Close()
+}
+
+func (p *gnetPipe) LocalAddr() net.Addr {
+	return p.localAddr
+}
+
+func (p *gnetPipe) RemoteAddr() net.Addr {
+	return p.remoteAddr
+}
+
+func (p *gnetPipe) SetDeadline(t time.Time) error {
+	return nil
+}
+
+func (p *gnetPipe) SetReadDeadline(t time.Time) error {
+	return nil
+}
+
+func (p *gnetPipe) SetWriteDeadline(t time.Time) error {
+	return nil
+}
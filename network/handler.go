@@ -33,8 +33,15 @@ func (h *MQTTConnectionHandler) OnOpen(conn types.Conn) {
 
 // OnMessage 处理接收到的消息
 func (h *MQTTConnectionHandler) OnMessage(conn types.Conn, data []byte) {
-	// 解析MQTT报文
-	packet, err := mqtt.DecodePacket(data)
+	h.broker.AddBytesReceived(len(data))
+
+	// 超过最大报文长度时由Broker断开连接
+	if !h.broker.AcceptPacketSize(conn, len(data)) {
+		return
+	}
+
+	// 按连接协商的协议版本解析MQTT报文
+	packet, err := mqtt.DecodePacket(data, h.broker.ProtocolVersion(conn))
 	if err != nil {
 		h.logger.Error("Failed to parse MQTT packet", "error", err)
 		conn.Close()
@@ -45,6 +52,17 @@ func (h *MQTTConnectionHandler) OnMessage(conn types.Conn, data []byte) {
 	h.broker.HandlePacket(conn, packet)
 }
 
+// MaxPacketSize 接收报文的最大长度
+func (h *MQTTConnectionHandler) MaxPacketSize() int {
+	return h.broker.MaxPacketSize()
+}
+
+// OnPacketTooLarge 处理超过最大长度的报文
+func (h *MQTTConnectionHandler) OnPacketTooLarge(conn types.Conn, size int) {
+	h.broker.AddBytesReceived(size)
+	h.broker.AcceptPacketSize(conn, size)
+}
+
 // OnClose 处理连接关闭
 func (h *MQTTConnectionHandler) OnClose(conn types.Conn, err error) {
 	h.broker.RemoveClient(conn)
@@ -2,6 +2,7 @@ package network
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"log/slog"
 	"net"
@@ -10,13 +11,14 @@ import (
 
 // TCPServer 标准Net TCP服务器
 type TCPServer struct {
-	address  string
-	handler  ConnHandler
-	listener net.Listener
-	wg       sync.WaitGroup
-	ctx      context.Context
-	cancel   context.CancelFunc
-	logger   *slog.Logger
+	address   string
+	tlsConfig *tls.Config // 不为nil时使用TLS
+	handler   ConnHandler
+	listener  net.Listener
+	wg        sync.WaitGroup
+	ctx       context.Context
+	cancel    context.CancelFunc
+	logger    *slog.Logger
 }
 
 // NewTCPServer 创建新的TCP服务器
@@ -31,6 +33,13 @@ func NewTCPServer(address string, handler ConnHandler, logger *slog.Logger) *TCP
 	}
 }
 
+// NewTLSServer 创建新的TLS服务器
+func NewTLSServer(address string, tlsConfig *tls.Config, handler ConnHandler, logger *slog.Logger) *TCPServer {
+	s := NewTCPServer(address, handler, logger)
+	s.tlsConfig = tlsConfig
+	return s
+}
+
 // Start 启动TCP服务器
 func (s *TCPServer) Start(ctx context.Context) error {
 	s.ctx, s.cancel = context.WithCancel(ctx)
@@ -41,7 +50,12 @@ func (s *TCPServer) Start(ctx context.Context) error {
 		return fmt.Errorf("failed to listen on %s: %w", s.address, err)
 	}
 
-	s.logger.Info("TCP server started", "address", s.address)
+	if s.tlsConfig != nil {
+		s.listener = tls.NewListener(s.listener, s.tlsConfig)
+		s.logger.Info("TLS server started", "address", s.address)
+	} else {
+		s.logger.Info("TCP server started", "address", s.address)
+	}
 
 	s.wg.Add(1)
 	go s.acceptLoop()
@@ -86,34 +100,5 @@ func (s *TCPServer) acceptLoop() {
 // handleConnection 处理单个连接
 func (s *TCPServer) handleConnection(conn net.Conn) {
 	defer s.wg.Done()
-	defer conn.Close()
-
-	s.logger.Debug("New TCP connection", "remote_addr", conn.RemoteAddr().String())
-
-	// 包装为标准连接
-	tcpConn := NewTCPConn(conn)
-
-	// 通知处理器有新连接
-	s.handler.OnOpen(tcpConn)
-
-	// 读取循环
-	buffer := make([]byte, 4096)
-	for {
-		select {
-		case <-s.ctx.Done():
-			return
-		default:
-			n, err := conn.Read(buffer)
-			if err != nil {
-				s.handler.OnClose(tcpConn, err)
-				return
-			}
-
-			if n > 0 {
-				data := make([]byte, n)
-				copy(data, buffer[:n])
-				s.handler.OnMessage(tcpConn, data)
-			}
-		}
-	}
+	serveConn(s.ctx, conn, s.handler, s.logger)
 }
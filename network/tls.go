@@ -0,0 +1,52 @@
+package network
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// TLSConfig TLS监听配置
+type TLSConfig struct {
+	CertFile          string // 服务端证书（PEM）
+	KeyFile           string // 服务端私钥（PEM）
+	ClientCAFile      string // 校验客户端证书的CA证书（PEM），为空时不请求客户端证书
+	RequireClientCert bool   // 为true时客户端必须提供证书（mTLS），否则只校验客户端提供的证书
+}
+
+// NewTLSConfig 加载证书创建tls.Config
+func NewTLSConfig(config TLSConfig) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load certificate: %w", err)
+	}
+
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if config.ClientCAFile == "" {
+		if config.RequireClientCert {
+			return nil, errors.New("client CA file is required to verify client certificates")
+		}
+		return tlsConfig, nil
+	}
+
+	pem, err := os.ReadFile(config.ClientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read client CA file: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in %s", config.ClientCAFile)
+	}
+	tlsConfig.ClientCAs = pool
+	tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	if config.RequireClientCert {
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
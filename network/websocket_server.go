@@ -2,6 +2,8 @@ package network
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
 	"log/slog"
 	"net"
@@ -19,18 +21,20 @@ var upgrader = websocket.Upgrader{
 
 // WebSocketServer WebSocket服务器
 type WebSocketServer struct {
-	address string
-	handler ConnHandler
-	server  *http.Server
-	wg      sync.WaitGroup
-	ctx     context.Context
-	cancel  context.CancelFunc
-	logger  *slog.Logger
+	address   string
+	tlsConfig *tls.Config // 不为nil时使用WSS
+	handler   ConnHandler
+	server    *http.Server
+	wg        sync.WaitGroup
+	ctx       context.Context
+	cancel    context.CancelFunc
+	logger    *slog.Logger
 }
 
 // WebSocketConn WebSocket连接包装器
 type WebSocketConn struct {
-	conn *websocket.Conn
+	conn  *websocket.Conn
+	state *tls.ConnectionState // WSS连接的TLS状态
 }
 
 func (w *WebSocketConn) Read(b []byte) (n int, err error) {
@@ -65,6 +69,14 @@ func (w *WebSocketConn) RemoteAddr() net.Addr {
 	return w.conn.RemoteAddr()
 }
 
+// PeerCertificates WSS连接上客户端提供的证书，非TLS连接返回nil
+func (w *WebSocketConn) PeerCertificates() []*x509.Certificate {
+	if w.state == nil {
+		return nil
+	}
+	return w.state.PeerCertificates
+}
+
 // NewWebSocketServer 创建新的WebSocket服务器
 func NewWebSocketServer(address string, handler ConnHandler, logger *slog.Logger) *WebSocketServer {
 	if logger == nil {
@@ -77,6 +89,13 @@ func NewWebSocketServer(address string, handler ConnHandler, logger *slog.Logger
 	}
 }
 
+// NewWebSocketTLSServer 创建新的WSS服务器
+func NewWebSocketTLSServer(address string, tlsConfig *tls.Config, handler ConnHandler, logger *slog.Logger) *WebSocketServer {
+	s := NewWebSocketServer(address, handler, logger)
+	s.tlsConfig = tlsConfig
+	return s
+}
+
 // Start 启动WebSocket服务器
 func (s *WebSocketServer) Start(ctx context.Context) error {
 	s.ctx, s.cancel = context.WithCancel(ctx)
@@ -85,8 +104,9 @@ func (s *WebSocketServer) Start(ctx context.Context) error {
 	mux.HandleFunc("/", s.handleWebSocket)
 
 	s.server = &http.Server{
-		Addr:    s.address,
-		Handler: mux,
+		Addr:      s.address,
+		Handler:   mux,
+		TLSConfig: s.tlsConfig,
 	}
 
 	s.logger.Info("WebSocket server started", "address", s.address)
@@ -114,7 +134,14 @@ func (s *WebSocketServer) Stop() error {
 func (s *WebSocketServer) serve() {
 	defer s.wg.Done()
 
-	if err := s.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+	var err error
+	if s.tlsConfig != nil {
+		// 证书已在TLSConfig中
+		err = s.server.ListenAndServeTLS("", "")
+	} else {
+		err = s.server.ListenAndServe()
+	}
+	if err != nil && err != http.ErrServerClosed {
 		s.logger.Error("WebSocket server failed", "error", err)
 	}
 }
@@ -127,7 +154,7 @@ func (s *WebSocketServer) handleWebSocket(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	wsConn := &WebSocketConn{conn: conn}
+	wsConn := &WebSocketConn{conn: conn, state: r.TLS}
 	s.logger.Debug("New WebSocket connection", "remote_addr", conn.RemoteAddr().String())
 
 	// 通知处理器有新连接
@@ -1,6 +1,9 @@
 package types
 
-import "net"
+import (
+	"crypto/x509"
+	"net"
+)
 
 // Conn 通用连接接口
 type Conn interface {
@@ -9,3 +12,8 @@ type Conn interface {
 	Close() error
 	RemoteAddr() net.Addr
 }
+
+// CertificateConn 可以提供客户端证书的连接（TLS/mTLS）
+type CertificateConn interface {
+	PeerCertificates() []*x509.Certificate
+}
@@ -2,24 +2,30 @@ package types
 
 import (
 	"time"
+
+	"busy-cloud/gnet-mqtt/mqtt"
 )
 
 // Client 表示一个MQTT客户端连接
 type Client struct {
-	ClientID     []byte
-	CleanSession bool
-	KeepAlive    uint16
-	Connected    bool
-	WillMessage  *WillMessage
-	ConnType     string
+	ClientID              []byte
+	Username              []byte
+	CleanSession          bool
+	KeepAlive             uint16
+	Connected             bool
+	WillMessage           *WillMessage
+	ConnType              string
+	ProtocolVersion       byte
+	SessionExpiryInterval uint32 // 会话过期间隔（秒），0表示会话随连接结束
 }
 
 // WillMessage 遗嘱消息
 type WillMessage struct {
-	Topic   []byte
-	Payload []byte
-	QoS     byte
-	Retain  bool
+	Topic      []byte
+	Payload    []byte
+	QoS        byte
+	Retain     bool
+	Properties *mqtt.Properties
 }
 
 // Subscription 订阅关系
@@ -30,11 +36,31 @@ type Subscription struct {
 
 // Message 发布的消息
 type Message struct {
-	Topic    []byte
-	Payload  []byte
-	QoS      byte
-	Retain   bool
-	PacketID uint16
+	Topic       []byte
+	Payload     []byte
+	QoS         byte
+	Retain      bool
+	PacketID    uint16
+	PublisherID []byte           // 发布者ClientID
+	Properties  *mqtt.Properties // MQTT 5.0 发布属性
+	ExpiresAt   time.Time        // 过期时间，零值表示永不过期
+}
+
+// Expired 消息在now时是否已过期
+func (m *Message) Expired(now time.Time) bool {
+	return !m.ExpiresAt.IsZero() && now.After(m.ExpiresAt)
+}
+
+// ExpiryInterval 消息在now时剩余的过期间隔（秒，向上取整），ok为false表示永不过期
+func (m *Message) ExpiryInterval(now time.Time) (interval uint32, ok bool) {
+	if m.ExpiresAt.IsZero() {
+		return 0, false
+	}
+	remaining := m.ExpiresAt.Sub(now)
+	if remaining <= 0 {
+		return 0, true
+	}
+	return uint32((remaining + time.Second - 1) / time.Second), true
 }
 
 // ClientContext 客户端上下文